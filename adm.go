@@ -6,7 +6,9 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
@@ -61,10 +63,20 @@ func (cmd *Command) Admin(args ...string) {
 		runtime.Goexit()
 	}
 	adm.Debug.Set(cmd.Cfg.Name)
-	if err = adm.repos.Set(cmd.Cfg.Dir); err != nil {
+	var st Storage
+	if st, err = NewStorage(cmd.Cfg.Storage, cmd.Cfg.Dir); err != nil {
+		runtime.Goexit()
+	}
+	if err = adm.repos.Set(st); err != nil {
 		runtime.Goexit()
 	}
 	defer func() { adm.repos.Reset() }()
+	if err = adm.repos.Set(cmd.Cfg.Dir); err != nil {
+		runtime.Goexit()
+	}
+	if err = adm.repos.Recover(&adm); err != nil {
+		runtime.Goexit()
+	}
 	adm.asn.Init()
 	adm.asn.Set(&adm.repos)
 	if err = adm.Connect(url); err != nil {
@@ -296,6 +308,7 @@ func (adm *Adm) handler() {
 					pdu.Clone()
 					adm.clich <- pdu
 				} else {
+					pdu.Clone()
 					adm.ObjDump(pdu)
 				}
 			default:
@@ -314,7 +327,18 @@ func (adm *Adm) IsService(key *PubEncr) bool {
 	return *key == *adm.cmd.Cfg.Keys.Server.Pub.Encr
 }
 
-func (adm *Adm) Exec(args ...string) (err error) {
+// Exec sends the command and its "-" content from stdin then writes the
+// acknowledgment to stdout; "upload NAME -" and "upload ID -" are sent in
+// chunks.
+func (adm *Adm) Exec(args ...string) error {
+	if len(args) == 3 && args[0] == "upload" && args[2] == "-" {
+		return adm.Upload(args[1], adm.cmd.Stdin)
+	}
+	return adm.exec(adm.cmd.Stdout, adm.cmd.Stdin, args...)
+}
+
+func (adm *Adm) exec(out io.Writer, in io.Reader,
+	args ...string) (err error) {
 	var pdu *PDU
 	for _, arg := range args {
 		if arg == "-" {
@@ -334,14 +358,14 @@ func (adm *Adm) Exec(args ...string) (err error) {
 	for _, arg := range args {
 		if arg == "-" {
 			pdu.Write([]byte{0, 0}[:])
-			pdu.ReadFrom(adm.cmd.Stdin)
+			pdu.ReadFrom(in)
 			break
 		}
 	}
 	adm.asn.acker.Map(req, func(req Req, err error, ack *PDU) error {
 		adm.asn.acker.UnMap(req)
 		if err == nil {
-			ack.WriteTo(adm.cmd.Stdout)
+			ack.WriteTo(out)
 		}
 		adm.done.req <- err
 		return err
@@ -413,3 +437,77 @@ func (adm *Adm) script() error {
 	}
 	return scanner.Err()
 }
+
+// spool returns a seekable reader of the given, copying it to a tmp file
+// unless it's a regular file.
+func (adm *Adm) spool(r io.Reader) (io.ReadSeeker, func(), error) {
+	if f, ok := r.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			return f, func() {}, nil
+		}
+	}
+	tmp := adm.repos.tmp.New()
+	if _, err := io.Copy(tmp, r); err != nil {
+		adm.repos.tmp.Free(tmp)
+		return nil, nil, err
+	}
+	return tmp, func() { adm.repos.tmp.Free(tmp) }, nil
+}
+
+// Upload the content of the given reader in acknowledged chunks to the named
+// blob or resume the interrupted upload of the given ID.
+func (adm *Adm) Upload(name string, r io.Reader) (err error) {
+	rs, free, err := adm.spool(r)
+	if err != nil {
+		return
+	}
+	defer free()
+	if _, err = rs.Seek(0, os.SEEK_SET); err != nil {
+		return
+	}
+	sum := NewSumOf(rs)
+	size, err := rs.Seek(0, os.SEEK_END)
+	if err != nil {
+		return
+	}
+	var (
+		id  string
+		off int64
+		out bytes.Buffer
+	)
+	if IsUploadId(name) {
+		err = adm.exec(&out, nil, "upload", name)
+	} else {
+		err = adm.exec(&out, nil, "upload", name, fmt.Sprint(size))
+	}
+	if err != nil {
+		return
+	}
+	if _, err = fmt.Sscan(out.String(), &id, &off); err != nil {
+		return
+	}
+	// the ID is needed to resume an interrupted upload
+	if off > 0 {
+		fmt.Fprintln(adm.cmd.Stderr, "resuming upload", id, "at", off)
+	} else {
+		fmt.Fprintln(adm.cmd.Stderr, "upload", id)
+	}
+	for off < size {
+		if _, err = rs.Seek(off, os.SEEK_SET); err != nil {
+			return
+		}
+		n := int64(UploadChunkSz)
+		if size-off < n {
+			n = size - off
+		}
+		out.Reset()
+		if err = adm.exec(&out, io.LimitReader(rs, n), "upload", id,
+			fmt.Sprint(off), "-"); err != nil {
+			return
+		}
+		if _, err = fmt.Sscan(out.String(), &off); err != nil {
+			return
+		}
+	}
+	return adm.exec(adm.cmd.Stdout, nil, "upload", id, sum.FullString())
+}
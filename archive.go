@@ -0,0 +1,253 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Archive records
+const (
+	ArchiveMagic = "asn-archive 1"
+	ArchiveBlob  = "blob" // SUM SIZE followed by SIZE bytes of sum file
+	ArchiveLink  = "link" // SUM USER NAME
+	ArchiveEnd   = "end"
+)
+
+// ArchiveStats summarizes an import.
+type ArchiveStats struct {
+	Blobs, Links, Skipped, Bad int
+}
+
+func (stats ArchiveStats) String() string {
+	return fmt.Sprintf("%d blobs, %d links, %d skipped, %d bad",
+		stats.Blobs, stats.Links, stats.Skipped, stats.Bad)
+}
+
+// sumString returns the full sum string of the given sum file name.
+func (repos *Repos) sumString(fn string) string {
+	return strings.Replace(repos.DePrefix(fn), ReposPS, "", 1)
+}
+
+// Export writes an archive of the sum files with a blob time after the
+// given epoch, in sum order, followed by a manifest of the user links to
+// them. Marks aren't exported.
+func (repos *Repos) Export(w io.Writer, after time.Time) error {
+	var fns []string
+	bw := bufio.NewWriter(w)
+	err := repos.Filter(after, func(fn string) error {
+		fns = append(fns, fn)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(fns)
+	fmt.Fprintln(bw, ArchiveMagic)
+	for _, fn := range fns {
+		if err = repos.exportBlob(bw, fn); err != nil {
+			return err
+		}
+	}
+	err = repos.storage.Users(func(keystr string) error {
+		dn := repos.Join(userDN(keystr))
+		return repos.storage.Walk(dn, func(fn string) error {
+			if strings.HasSuffix(fn, filepath.FromSlash(AsnMark)) {
+				return nil
+			}
+			if !after.IsZero() {
+				if t, err := repos.LinkTime(fn); err != nil ||
+					!t.After(after) {
+					return nil
+				}
+			}
+			f, err := repos.Open(fn)
+			if err != nil {
+				return err
+			}
+			sum := NewSumOf(f)
+			f.Close()
+			fmt.Fprintln(bw, ArchiveLink, sum.FullString(), keystr,
+				filepath.ToSlash(fn[len(dn)+1:]))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(bw, ArchiveEnd)
+	return bw.Flush()
+}
+
+func (repos *Repos) exportBlob(w io.Writer, fn string) error {
+	f, err := repos.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, ArchiveBlob, repos.sumString(fn), fi.Size())
+	_, err = io.CopyN(w, f, fi.Size())
+	return err
+}
+
+// Import reads an archive, verifying and storing each blob with a time
+// after the given epoch that isn't already present, then links any missing
+// manifest entries to present sum files. Problems are reported to w. The
+// caches of the users with imported links are reloaded.
+func (repos *Repos) Import(x Sender, r io.Reader, after time.Time,
+	w io.Writer) (stats ArchiveStats, err error) {
+	owners := make(map[string]struct{})
+	defer func() {
+		for keystr := range owners {
+			if u := repos.users.UserString(keystr); u != nil {
+				repos.reloadCache(u)
+			}
+		}
+	}()
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil || strings.TrimSuffix(line, "\n") != ArchiveMagic {
+		return stats, &Error{"import", "not an archive"}
+	}
+	for {
+		if line, err = br.ReadString('\n'); err != nil {
+			if err == io.EOF {
+				err = &Error{"import", "truncated archive"}
+			}
+			return
+		}
+		v := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 4)
+		switch {
+		case v[0] == ArchiveEnd:
+			return
+		case v[0] == ArchiveBlob && len(v) == 3 && len(v[1]) == 2*SumSz:
+			var size int64
+			if _, err = fmt.Sscan(v[2], &size); err != nil {
+				return
+			}
+			if err = repos.importBlob(x, br, v[1], size, after,
+				w, &stats); err != nil {
+				return
+			}
+		case v[0] == ArchiveLink && len(v) == 4 && len(v[1]) == 2*SumSz:
+			if repos.importLink(v[1], v[2], v[3], w, &stats) {
+				owners[v[2]] = struct{}{}
+			}
+		default:
+			err = &Error{strings.TrimSpace(line), "invalid record"}
+			return
+		}
+	}
+}
+
+func (repos *Repos) importBlob(x Sender, r io.Reader, s string, size int64,
+	after time.Time, w io.Writer, stats *ArchiveStats) error {
+	f := repos.tmp.New()
+	defer repos.tmp.Free(f)
+	h := sha512.New()
+	if _, err := io.CopyN(io.MultiWriter(f, h), r, size); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum([]byte{})) != s {
+		fmt.Fprintln(w, s[:16], "sum mismatch")
+		stats.Bad += 1
+		return nil
+	}
+	if _, err := repos.storage.Stat(repos.Expand(s)); err == nil {
+		stats.Skipped += 1
+		return nil
+	}
+	fh := new(FH)
+	f.Seek(0, os.SEEK_SET)
+	if _, err := fh.ReadFrom(f); err != nil {
+		fmt.Fprintln(w, s[:16], err)
+		stats.Bad += 1
+		return nil
+	}
+	if !after.IsZero() && !fh.Blob.Time.After(after) {
+		stats.Skipped += 1
+		return nil
+	}
+	// Store writes the version and id then tees the blob header
+	f.Seek(0, os.SEEK_SET)
+	fh.V.ReadFrom(f)
+	fh.Id.ReadFrom(f)
+	sum, err := repos.Store(x, fh.V, nil, f)
+	if err != nil {
+		fmt.Fprintln(w, s[:16], err)
+		stats.Bad += 1
+		return nil
+	}
+	if sum.FullString() != s {
+		fmt.Fprintln(w, s[:16], "stored as", sum.FullString()[:16])
+	}
+	stats.Blobs += 1
+	return nil
+}
+
+// importLink links and indexes a missing manifest entry, returning true if
+// linked.
+func (repos *Repos) importLink(s, keystr, name string, w io.Writer,
+	stats *ArchiveStats) (linked bool) {
+	if len(keystr) != 2*PubEncrSz || !IsUser(keystr[ReposTopSz:]) ||
+		name == "" || strings.Contains(name, "..") {
+		fmt.Fprintln(w, "invalid link", keystr, name)
+		stats.Bad += 1
+		return
+	}
+	src := repos.Expand(s)
+	dst := repos.Expand(keystr, name)
+	if _, err := repos.storage.Stat(dst); err == nil {
+		return
+	}
+	fh, err := repos.ReadFileHeader(src)
+	if err != nil {
+		fmt.Fprintln(w, "no", s[:16], "for", keystr[:16]+"/"+name)
+		stats.Bad += 1
+		return
+	}
+	if repos.users.UserString(keystr) == nil {
+		if _, err = repos.NewUser(keystr); err != nil {
+			fmt.Fprintln(w, keystr[:16], err)
+			stats.Bad += 1
+			return
+		}
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = r.(error)
+			}
+		}()
+		repos.LN(src, dst)
+	}()
+	if err != nil {
+		fmt.Fprintln(w, keystr[:16]+"/"+name, err)
+		stats.Bad += 1
+		return
+	}
+	var sum Sum
+	if b, xerr := hex.DecodeString(s); xerr == nil && len(b) == SumSz {
+		copy(sum[:], b)
+		if repos.isLinked(&sum, &fh.Blob) {
+			repos.Index(&sum, &fh.Blob, false, true)
+		}
+	}
+	stats.Links += 1
+	return true
+}
@@ -0,0 +1,177 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	src := newTestRepos(t, "mem")
+	defer freeTestRepos(src)
+	dst := newTestRepos(t, "fs")
+	defer freeTestRepos(dst)
+	x := new(testSender)
+	owner := newTestUser(t, src)
+	t0 := time.Now().Add(-time.Hour)
+	if _, err := testStoreAt(src, x, owner, owner, "old", "old",
+		t0); err != nil {
+		t.Fatal(err)
+	}
+	after := t0.Add(time.Minute)
+	if _, err := testStore(src, x, owner, owner, "new", "new"); err != nil {
+		t.Fatal(err)
+	}
+	archive := new(bytes.Buffer)
+	if err := src.Export(archive, after); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(archive.Bytes(), []byte(" old\n")) {
+		t.Error("exported link before epoch")
+	}
+	b := archive.Bytes()
+	stats, err := dst.Import(x, bytes.NewReader(b), Time0, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blobs == 0 || stats.Bad != 0 {
+		t.Error("import", stats)
+	}
+	fn := dst.Join(owner.Join("new"))
+	if s, err := testContent(dst, fn); err != nil || s != "new" {
+		t.Error("imported", s, err)
+	}
+	if _, err = dst.storage.Stat(dst.Join(owner.Join("old"))); err == nil {
+		t.Error("imported blob before epoch")
+	}
+	// a repeated import skips everything that's present
+	stats, err = dst.Import(x, bytes.NewReader(b), Time0, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blobs != 0 || stats.Links != 0 || stats.Bad != 0 ||
+		stats.Skipped == 0 {
+		t.Error("reimport", stats)
+	}
+	// restore a missing link from the manifest
+	if err = dst.Unlink(fn); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = dst.Import(x, bytes.NewReader(b), Time0, ioutil.Discard)
+	if err != nil || stats.Links != 1 {
+		t.Error("relink", stats, err)
+	}
+	if s, err := testContent(dst, fn); err != nil || s != "new" {
+		t.Error("relinked", s, err)
+	}
+}
+
+func TestArchiveInvalid(t *testing.T) {
+	src := newTestRepos(t, "mem")
+	defer freeTestRepos(src)
+	dst := newTestRepos(t, "mem")
+	defer freeTestRepos(dst)
+	x := new(testSender)
+	owner := newTestUser(t, src)
+	if _, err := testStore(src, x, owner, owner, "a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	archive := new(bytes.Buffer)
+	if err := src.Export(archive, Time0); err != nil {
+		t.Fatal(err)
+	}
+	s := archive.String()
+	for _, c := range []struct{ desc, archive string }{
+		{"not an archive", "hello\n"},
+		{"truncated", s[:len(s)-len(ArchiveEnd)-1]},
+		{"invalid record", ArchiveMagic + "\nbogus\n" + ArchiveEnd + "\n"},
+	} {
+		_, err := dst.Import(x, strings.NewReader(c.archive), Time0,
+			ioutil.Discard)
+		if err == nil {
+			t.Error("imported", c.desc)
+		}
+	}
+	// corrupt the content of the first blob
+	i := strings.Index(s, "\n"+ArchiveBlob+" ")
+	i += strings.Index(s[i+1:], "\n") + 2
+	b := []byte(s)
+	b[i] ^= 0xff
+	w := new(bytes.Buffer)
+	stats, err := dst.Import(x, bytes.NewReader(b), Time0, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Bad == 0 || !strings.Contains(w.String(), "sum mismatch") {
+		t.Error("corrupt blob", stats, w)
+	}
+	sum := strings.Repeat("0", 2*SumSz)
+	for _, link := range []string{
+		ArchiveLink + " " + sum + " bogus a",
+		ArchiveLink + " " + sum + " " + owner.FullString() + " ../a",
+		ArchiveLink + " " + sum + " " + owner.FullString() + " nosuch",
+	} {
+		stats, err = dst.Import(x, strings.NewReader(ArchiveMagic+"\n"+
+			link+"\n"+ArchiveEnd+"\n"), Time0, ioutil.Discard)
+		if err != nil || stats.Bad != 1 || stats.Links != 0 {
+			t.Error(link, stats, err)
+		}
+	}
+}
+
+func TestArchiveLinkCache(t *testing.T) {
+	src := newTestRepos(t, "mem")
+	defer freeTestRepos(src)
+	dst := newTestRepos(t, "mem")
+	defer freeTestRepos(dst)
+	x := new(testSender)
+	owner := newTestUser(t, src)
+	moderator := newTestUser(t, src)
+	name := AsnModerators + "/" + moderator.FullString()
+	for _, v := range [][2]string{{name, ""}, {"a", "a"}} {
+		if _, err := testStore(src, x, owner, owner, v[0],
+			v[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := new(bytes.Buffer)
+	if err := src.Export(archive, Time0); err != nil {
+		t.Fatal(err)
+	}
+	b := archive.Bytes()
+	if _, err := dst.Import(x, bytes.NewReader(b), Time0,
+		ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	// drop the links but keep their sum files for the manifest
+	u := dst.users.User(&owner.key)
+	for _, fn := range []string{name, "a"} {
+		if err := dst.Unlink(dst.Join(u.Join(fn))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst.reloadCache(u)
+	if moderator.OnList(u.cache.Moderators()) {
+		t.Fatal("kept unlinked moderator")
+	}
+	stats, err := dst.Import(x, bytes.NewReader(b), Time0, ioutil.Discard)
+	if err != nil || stats.Links != 2 {
+		t.Fatal("relink", stats, err)
+	}
+	if !moderator.OnList(u.cache.Moderators()) {
+		t.Error("relinked moderator isn't cached")
+	}
+	fn := dst.Join(u.Join("a"))
+	dst.index.Lock()
+	_, indexed := dst.index.links[dst.DePrefix(fn)]
+	dst.index.Unlock()
+	if !indexed {
+		t.Error("relinked blob isn't indexed")
+	}
+}
@@ -30,6 +30,7 @@ var (
 	atf struct {
 		debug.Debug
 		clean bool
+		mem   bool
 		trace string
 	}
 	atm = AsnTestMap{
@@ -51,9 +52,8 @@ var (
 func init() {
 	flag.BoolVar(&atf.clean, "clean", false,
 		"clean repos before test")
-	if testing.Verbose() {
-		atf.trace = "trace flush\n"
-	}
+	flag.BoolVar(&atf.mem, "mem", false,
+		"use in-memory repos")
 	for _, x := range atm {
 		x.cmd.Stdin = &x.in
 		x.cmd.Stdout = &x.out
@@ -63,6 +63,9 @@ func init() {
 }
 
 func TestAsn(t *testing.T) {
+	if testing.Verbose() {
+		atf.trace = "trace flush\n"
+	}
 	atf.Debug.Set("asn_test")
 	f, err := debug.Create("test.log")
 	if err != nil {
@@ -80,6 +83,9 @@ func TestAsn(t *testing.T) {
 		if err := x.cmd.Cfg.Parse(x.fn); err != nil {
 			t.Fatal(err)
 		}
+		if atf.mem {
+			x.cmd.Cfg.Storage = "mem"
+		}
 	}
 	admin := atm["admin"]
 	sf := atm["sf"]
@@ -35,6 +35,11 @@ const (
 	BlobNameLenOff = BlobTimeOff + BlobTimeSz
 	BlobNameLenSz  = 1
 	BlobNameOff    = BlobNameLenOff + BlobNameLenSz
+	// BlobMagicV1 headers have a varint namelen for names longer than
+	// BlobNameMaxV0; BlobNameOff is then the least offset of the name.
+	BlobMagicV1   = "asnmagv1"
+	BlobNameMaxV0 = 255
+	BlobNameMax   = 4096
 )
 
 var (
@@ -42,7 +47,8 @@ var (
 		debug.Debug
 		c chan *Blob
 	}
-	ErrNotMagic = errors.New("Not Magic")
+	ErrNotMagic    = errors.New("Not Magic")
+	ErrNameTooLong = errors.New("Name too long")
 )
 
 func init() {
@@ -84,22 +90,60 @@ func BlobSeek(r io.ReadSeeker) (n int64, err error) {
 
 // blobSeek will panic on error so the calling function must recover.
 func blobSeek(r io.ReadSeeker) int64 {
-	var b [1]byte
-	_, err := r.Seek(BlobNameLenOff, os.SEEK_SET)
+	var b [BlobMagicSz]byte
+	_, err := r.Seek(BlobMagicOff, os.SEEK_SET)
 	if err != nil {
 		panic(err)
 	}
-	_, err = r.Read(b[:])
+	if _, err = io.ReadFull(r, b[:]); err != nil {
+		panic(err)
+	}
+	_, err = r.Seek(BlobNameLenOff, os.SEEK_SET)
 	if err != nil {
 		panic(err)
 	}
-	n, err := r.Seek(int64(b[0]), os.SEEK_CUR)
+	l, err := readNameLen(r, string(b[:]))
+	if err != nil {
+		panic(err)
+	}
+	n, err := r.Seek(int64(l), os.SEEK_CUR)
 	if err != nil {
 		panic(err)
 	}
 	return n
 }
 
+// readNameLen reads the namelen of a header with the given magic.
+func readNameLen(r io.Reader, magic string) (int, error) {
+	var b [1]byte
+	switch magic {
+	case BlobMagic:
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, err
+		}
+		return int(b[0]), nil
+	case BlobMagicV1:
+		var l uint64
+		for shift := uint(0); ; shift += 7 {
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return 0, err
+			}
+			l |= uint64(b[0]&0x7f) << shift
+			if b[0] < 0x80 {
+				break
+			}
+			if shift > 21 {
+				return 0, ErrNameTooLong
+			}
+		}
+		if l > BlobNameMax {
+			return 0, ErrNameTooLong
+		}
+		return int(l), nil
+	}
+	return 0, ErrNotMagic
+}
+
 type Blob struct {
 	Owner  PubEncr
 	Author PubEncr
@@ -107,6 +151,10 @@ type Blob struct {
 	Name   string
 	wo     int64
 	l      int
+	magic  string
+	shift  uint
+	name   []byte
+	done   bool
 }
 
 func BlobPoolFlush() {
@@ -160,6 +208,11 @@ func (blob *Blob) Free() {
 		blob.Time = Time0
 		blob.Name = ""
 		blob.wo = 0
+		blob.l = 0
+		blob.magic = ""
+		blob.shift = 0
+		blob.name = blob.name[:0]
+		blob.done = false
 		select {
 		case blobs.c <- blob:
 		default:
@@ -170,7 +223,7 @@ func (blob *Blob) Free() {
 // Blob{}.ReadFrom *after* Id{}.ReadFrom(r)
 func (blob *Blob) ReadFrom(r io.Reader) (n int64, err error) {
 	var (
-		b [256]byte
+		b [BlobNameMax]byte
 		a accumulator.Int64
 	)
 	defer func() {
@@ -181,7 +234,8 @@ func (blob *Blob) ReadFrom(r io.Reader) (n int64, err error) {
 		n = int64(a)
 	}()
 	a.Accumulate(r.Read(b[:BlobMagicSz]))
-	if string(b[:a]) != BlobMagic {
+	magic := string(b[:a])
+	if magic != BlobMagic && magic != BlobMagicV1 {
 		err = ErrNotMagic
 		return
 	}
@@ -189,9 +243,11 @@ func (blob *Blob) ReadFrom(r io.Reader) (n int64, err error) {
 	a.Accumulate(r.Read(blob.Owner[:]))
 	a.Accumulate(r.Read(blob.Author[:]))
 	a.Accumulate((NBOReader{r}).ReadNBO(&blob.Time))
-	a.Accumulate(r.Read(b[:1]))
-	if l := int(b[0]); l > 0 {
-		a.Accumulate(r.Read(b[:l]))
+	cr := &countReader{r: r}
+	l, err := readNameLen(cr, magic)
+	a.Accumulate64(cr.n, err)
+	if l > 0 {
+		a.Accumulate(io.ReadFull(r, b[:l]))
 		blob.Name = string(b[:l])
 	} else {
 		blob.Name = ""
@@ -199,6 +255,17 @@ func (blob *Blob) ReadFrom(r io.Reader) (n int64, err error) {
 	return
 }
 
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n += int64(n)
+	return n, err
+}
+
 // RFC822Z returns formatted time.
 func (blob *Blob) RFC822Z() string { return blob.Time.Format(time.RFC822Z) }
 
@@ -220,14 +287,15 @@ func (blob *Blob) Write(b []byte) (n int, err error) {
 	switch {
 	case len(b) == 0:
 		blobs.Diag(debug.Depth(2), "empty write")
-	case blob.Name != "":
-		// done, ignore the reset
+	case blob.done:
+		// ignore the rest
 		return
 	case blob.wo < BlobMagicOff:
 		blob.wo += 1
 		b = b[1:]
 	case blob.wo >= BlobMagicOff && blob.wo < BlobRandomOff:
-		if string(b[:BlobMagicSz]) != BlobMagic {
+		blob.magic = string(b[:BlobMagicSz])
+		if blob.magic != BlobMagic && blob.magic != BlobMagicV1 {
 			err = ErrNotMagic
 		} else {
 			blob.wo += BlobMagicSz
@@ -251,16 +319,40 @@ func (blob *Blob) Write(b []byte) (n int, err error) {
 		blob.wo += 8
 		b = b[8:]
 	case blob.wo >= BlobNameLenOff && blob.wo < BlobNameOff:
-		blob.l = int(b[0])
+		if blob.magic == BlobMagicV1 {
+			blob.l |= int(b[0]&0x7f) << blob.shift
+			blob.shift += 7
+			if b[0] >= 0x80 {
+				if blob.shift > 21 {
+					err = ErrNameTooLong
+				}
+				b = b[1:]
+				break
+			}
+			if blob.l > BlobNameMax {
+				err = ErrNameTooLong
+				break
+			}
+		} else {
+			blob.l = int(b[0])
+		}
 		blob.wo += 1
 		b = b[1:]
+		if blob.l == 0 {
+			blob.Name = ""
+			blob.done = true
+			return
+		}
 	case blob.wo >= BlobNameOff:
-		if blob.l > n {
-			blobs.Diag(debug.Depth(2), "incomplete name:",
-				n, "bytes vs.", blob.l)
-			blob.l = n
+		i := blob.l - len(blob.name)
+		if i > len(b) {
+			i = len(b)
+		}
+		blob.name = append(blob.name, b[:i]...)
+		if len(blob.name) == blob.l {
+			blob.Name = string(blob.name)
+			blob.done = true
 		}
-		blob.Name = string(b[:blob.l])
 		return
 	}
 	if err == nil && len(b) > 0 {
@@ -280,14 +372,27 @@ func (blob *Blob) WriteTo(w io.Writer) (n int64, err error) {
 		}
 		n = int64(a)
 	}()
-	a.Accumulate(w.Write([]byte(BlobMagic)))
+	if len(blob.Name) > BlobNameMax {
+		err = ErrNameTooLong
+		return
+	} else if len(blob.Name) > BlobNameMaxV0 {
+		a.Accumulate(w.Write([]byte(BlobMagicV1)))
+	} else {
+		a.Accumulate(w.Write([]byte(BlobMagic)))
+	}
 	rand.Reader.Read(b[:BlobRandomSz])
 	a.Accumulate(w.Write(b[:BlobRandomSz]))
 	a.Accumulate(w.Write(blob.Owner[:]))
 	a.Accumulate(w.Write(blob.Author[:]))
 	a.Accumulate((NBOWriter{w}).WriteNBO(blob.Time))
-	b[0] = byte(len(blob.Name))
-	a.Accumulate(w.Write(b[:1]))
+	if len(blob.Name) > BlobNameMaxV0 {
+		var nl [binary.MaxVarintLen64]byte
+		a.Accumulate(w.Write(nl[:binary.PutUvarint(nl[:],
+			uint64(len(blob.Name)))]))
+	} else {
+		b[0] = byte(len(blob.Name))
+		a.Accumulate(w.Write(b[:1]))
+	}
 	if len(blob.Name) > 0 {
 		a.Accumulate(w.Write([]byte(blob.Name)))
 	}
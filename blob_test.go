@@ -0,0 +1,123 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBlobHeader returns the version, id and header of a blob with a name
+// of the given length.
+func testBlobHeader(t *testing.T, l int) (*Blob, []byte) {
+	owner, _, err := NewRandomEncrKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	author, _, err := NewRandomEncrKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := NewBlobWith(owner, author, strings.Repeat("n", l),
+		time.Unix(0, time.Now().UnixNano()))
+	b := new(bytes.Buffer)
+	Latest.WriteTo(b)
+	BlobId.Version(Latest).WriteTo(b)
+	if _, err = blob.WriteTo(b); err != nil {
+		t.Fatal(l, err)
+	}
+	b.WriteString("content")
+	return blob, b.Bytes()
+}
+
+func TestBlobHeader(t *testing.T) {
+	for _, c := range []struct {
+		l     int
+		magic string
+	}{
+		{0, BlobMagic},
+		{1, BlobMagic},
+		{BlobNameMaxV0, BlobMagic},
+		{BlobNameMaxV0 + 1, BlobMagicV1},
+		{BlobNameMax, BlobMagicV1},
+	} {
+		blob, b := testBlobHeader(t, c.l)
+		if magic := string(b[BlobMagicOff:BlobRandomOff]); magic !=
+			c.magic {
+			t.Error(c.l, "magic", magic)
+		}
+		rb := NewBlob()
+		r := bytes.NewReader(b[BlobMagicOff:])
+		if _, err := rb.ReadFrom(r); err != nil {
+			t.Error(c.l, err)
+		} else if rb.Name != blob.Name || rb.Owner != blob.Owner ||
+			rb.Author != blob.Author || !rb.Time.Equal(blob.Time) {
+			t.Error(c.l, "read", rb)
+		}
+		rb.Free()
+		// peeled from a stream
+		wb := NewBlob()
+		if _, err := wb.Write(b); err != nil {
+			t.Error(c.l, err)
+		}
+		if wb.Name != blob.Name || !wb.Time.Equal(blob.Time) {
+			t.Error(c.l, "peeled", wb)
+		}
+		wb.Free()
+		if n, err := BlobSeek(bytes.NewReader(b)); err != nil ||
+			string(b[n:]) != "content" {
+			t.Error(c.l, "seek", n, err)
+		}
+		blob.Free()
+	}
+}
+
+func TestBlobHeaderInvalid(t *testing.T) {
+	blob, _ := testBlobHeader(t, 0)
+	defer blob.Free()
+	blob.Name = strings.Repeat("n", BlobNameMax+1)
+	if _, err := blob.WriteTo(new(bytes.Buffer)); err != ErrNameTooLong {
+		t.Error("wrote long name", err)
+	}
+	// a V1 namelen beyond the limit
+	_, b := testBlobHeader(t, BlobNameMax)
+	b[BlobNameLenOff] = 0xff
+	b[BlobNameLenOff+1] = 0xff
+	rb := NewBlob()
+	if _, err := rb.ReadFrom(bytes.NewReader(b[BlobMagicOff:])); err !=
+		ErrNameTooLong {
+		t.Error("read long name", err)
+	}
+	rb.Free()
+	if _, err := BlobSeek(bytes.NewReader(b)); err != ErrNameTooLong {
+		t.Error("seek long name", err)
+	}
+	b[BlobMagicOff] = 'x'
+	rb = NewBlob()
+	if _, err := rb.ReadFrom(bytes.NewReader(b[BlobMagicOff:])); err !=
+		ErrNotMagic {
+		t.Error("read bad magic", err)
+	}
+	rb.Free()
+	// truncated headers
+	for _, l := range []int{0, BlobNameMaxV0 + 1} {
+		_, b = testBlobHeader(t, l)
+		end := len(b) - len("content")
+		for i := int(BlobMagicOff); i < end; i++ {
+			rb = NewBlob()
+			if _, err := rb.ReadFrom(bytes.NewReader(
+				b[BlobMagicOff:i])); err == nil {
+				t.Error(l, "read truncated at", i)
+			}
+			rb.Free()
+			if _, err := BlobSeek(bytes.NewReader(b[:i])); err ==
+				nil && i < int(BlobNameOff) {
+				t.Error(l, "seek truncated at", i)
+			}
+		}
+	}
+}
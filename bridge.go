@@ -0,0 +1,134 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apptimistco/asn/debug/file"
+	"github.com/apptimistco/asn/debug/mutex"
+)
+
+// UserTypeBridge is the asn/user content of bridge users.
+const UserTypeBridge = "bridge"
+
+// BridgeEcho is how long the sums of bridged messages are kept to drop those
+// echoed back by other bridge servers.
+var BridgeEcho = GCGrace
+
+// BridgeServers are those that a server refers bridge messages to, rather
+// than multicast them itself; none if it's a bridge server.
+type BridgeServers []string
+
+// IsBridgeLat returns true if the given latitude designates a bridge server;
+// that's beyond the poles but not the back-end servers.
+func IsBridgeLat(lat float64) bool {
+	return (lat < -90 || lat > 90) && lat >= -180 && lat <= 180
+}
+
+// BridgeServers returns the listed bridge servers unless this is one.
+func (c *Config) BridgeServers() (l BridgeServers) {
+	if IsBridgeLat(c.Lat) {
+		return
+	}
+	for _, s := range c.Server {
+		if !IsBridgeLat(s.Lat) {
+			continue
+		}
+		if s.Name != "" {
+			l = append(l, s.Name)
+		} else if s.Url != nil {
+			l = append(l, s.Url.String())
+		}
+	}
+	return
+}
+
+// reposBridged are the times of recently bridged messages by sum.
+type reposBridged struct {
+	mutex.Mutex
+	m map[Sum]time.Time
+}
+
+// BridgePermission returns nil if the author may multicast a message through
+// the owner's bridge; i.e. it's the admin or server, such as a mirror peer,
+// or it's an editor or invitee of a bridge user and this is a bridge server.
+func (repos *Repos) BridgePermission(owner, author *User) error {
+	if bytes.Equal(author.key.Bytes(), repos.svc.Admin.Pub.Encr.Bytes()) ||
+		bytes.Equal(author.key.Bytes(), repos.svc.Server.Pub.Encr.Bytes()) {
+		return nil
+	}
+	if len(repos.bridges) > 0 {
+		return &Error{AsnBridge, "use bridge server " +
+			strings.Join(repos.bridges, " or ")}
+	}
+	if owner.cache.UserType() != UserTypeBridge {
+		return &Error{owner.String(), "not a bridge"}
+	}
+	if author.MayEdit(owner) || author.OnList(owner.cache.Invites()) {
+		return nil
+	}
+	return os.ErrPermission
+}
+
+// Bridge sends the message to the signed-in invitees of the owner's bridge
+// unless it was already within BridgeEcho; it isn't retained so those
+// signed-out never receive it.
+func (repos *Repos) Bridge(x Sender, sum *Sum, owner *User, f *file.File) {
+	if repos.echoed(sum) {
+		return
+	}
+	x.Send(Mirrors, f)
+	for _, k := range owner.cache.Invites().Keys() {
+		x.Send(&k, f)
+	}
+}
+
+// echoed returns true if the message was bridged within BridgeEcho;
+// otherwise, it's recorded and those older are forgotten.
+func (repos *Repos) echoed(sum *Sum) bool {
+	now := time.Now()
+	repos.bridged.Lock()
+	defer repos.bridged.Unlock()
+	if repos.bridged.m == nil {
+		repos.bridged.m = make(map[Sum]time.Time)
+	}
+	for k, t := range repos.bridged.m {
+		if now.Sub(t) > BridgeEcho {
+			delete(repos.bridged.m, k)
+		}
+	}
+	if _, ok := repos.bridged.m[*sum]; ok {
+		return true
+	}
+	repos.bridged.m[*sum] = now
+	return false
+}
+
+// Members writes each invitee of the owner's bridge and whether it's
+// signed-in to this server.
+func (repos *Repos) Members(w io.Writer, owner *User) error {
+	if owner.cache.UserType() != UserTypeBridge {
+		return &Error{owner.String(), "not a bridge"}
+	}
+	on := make(map[string]struct{})
+	repos.users.ForEachLoggedInUser(func(u *User) error {
+		on[u.FullString()] = struct{}{}
+		return nil
+	})
+	for _, k := range owner.cache.Invites().Keys() {
+		state := "off"
+		if _, ok := on[k.FullString()]; ok {
+			state = "on"
+		}
+		fmt.Fprintln(w, k.FullString(), state)
+	}
+	return nil
+}
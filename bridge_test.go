@@ -0,0 +1,98 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestBridge returns a new bridge user with the given invitees.
+func newTestBridge(t *testing.T, repos *Repos, x Sender,
+	invitees ...*User) *User {
+	bridge := newTestUser(t, repos)
+	_, err := testStore(repos, x, bridge, bridge, AsnUser, UserTypeBridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range invitees {
+		_, err = testStore(repos, x, bridge, bridge,
+			AsnInvites+"/"+u.FullString(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bridge
+}
+
+func TestBridgeEcho(t *testing.T) {
+	defer func(d time.Duration) { BridgeEcho = d }(BridgeEcho)
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	invitee := newTestUser(t, repos)
+	bridge := newTestBridge(t, repos, x, invitee)
+	x.Reset()
+	// mirrors forward the same blob so its echo has the same sum
+	blob := NewBlobWith(&bridge.key, &invitee.key, AsnBridge, time.Now())
+	defer blob.Free()
+	b := new(bytes.Buffer)
+	if _, err := blob.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	b.WriteString("hi")
+	bridged := func() {
+		if _, err := repos.Store(x, Latest, nil,
+			bytes.NewReader(b.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bridged()
+	if x.Sent(&invitee.key) != 1 || x.Sent(Mirrors) != 1 {
+		t.Fatal("bridged", x.sent)
+	}
+	x.Reset()
+	bridged()
+	if len(x.sent) != 0 {
+		t.Error("bridged echo", x.sent)
+	}
+	BridgeEcho = 0
+	bridged()
+	if x.Sent(&invitee.key) != 1 {
+		t.Error("forgot bridged", x.sent)
+	}
+}
+
+func TestBridgePermission(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	invitee := newTestUser(t, repos)
+	stranger := newTestUser(t, repos)
+	bridge := newTestBridge(t, repos, x, invitee)
+	server := repos.users.User(repos.svc.Server.Pub.Encr)
+	if err := repos.Permission(bridge, invitee, AsnBridge); err != nil {
+		t.Error("invitee", err)
+	}
+	if err := repos.Permission(bridge, stranger,
+		AsnBridge); err != os.ErrPermission {
+		t.Error("stranger", err)
+	}
+	if err := repos.Permission(stranger, stranger, AsnBridge); err == nil {
+		t.Error("bridged through non-bridge")
+	}
+	repos.Set(BridgeServers{"bridge1"})
+	if err := repos.Permission(bridge, invitee, AsnBridge); err == nil {
+		t.Error("bridged through non-bridge server")
+	}
+	// mirror peers aren't referred to bridge servers
+	for _, u := range []*User{server, testAdmin(repos)} {
+		if err := repos.Permission(bridge, u, AsnBridge); err != nil {
+			t.Error(u, err)
+		}
+	}
+}
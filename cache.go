@@ -6,9 +6,9 @@ package main
 
 import (
 	"bytes"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -18,14 +18,19 @@ const (
 	AsnAuthor      = "asn/author"
 	AsnBridge      = "asn/bridge"
 	AsnEditors     = "asn/editors"
+	AsnHistory     = "asn/history"
 	AsnID          = "asn/user_id"
 	AsnInvites     = "asn/invites"
 	AsnMark        = "asn/mark"
 	AsnMessages    = "asn/messages"
 	AsnModerators  = "asn/moderators"
+	AsnPending     = "asn/pending"
+	AsnRejections  = "asn/rejections"
 	AsnRemovals    = "asn/removals"
 	AsnSubscribers = "asn/subscribers"
+	AsnTransaction = "asn/transaction"
 	AsnUser        = "asn/user"
+	AsnVisibility  = "asn/visibility"
 	AsnVouchers    = "asn/vouchers"
 )
 
@@ -67,13 +72,13 @@ func (c Cache) Invites() *PubEncrList {
 	return c.PubEncrList(AsnInvites)
 }
 
-func (c Cache) Load(dn string) error {
+func (c Cache) Load(st Storage, dn string) error {
 	for fn, e := range c {
-		if fn == AsnID {
+		if fn == AsnID || fn == AsnUser || fn == AsnVisibility {
 			e.Cacher = NewCacheBuffer()
 		}
 		pn := filepath.Join(dn, fn)
-		fi, err := os.Stat(pn)
+		fi, err := st.Stat(pn)
 		if err != nil {
 			if os.IsNotExist(err) {
 				err = nil
@@ -83,12 +88,12 @@ func (c Cache) Load(dn string) error {
 			}
 		}
 		if fi.IsDir() {
-			dir, err := ioutil.ReadDir(pn)
+			dir, err := st.Glob(filepath.Join(pn, "*"))
 			if err != nil {
 				return &Error{pn, err.Error()}
 			}
-			for _, fi := range dir {
-				keystr := fi.Name()
+			for _, entry := range dir {
+				keystr := filepath.Base(entry)
 				key, err := NewPubEncr(keystr)
 				if err != nil {
 					return err
@@ -97,7 +102,7 @@ func (c Cache) Load(dn string) error {
 			}
 			e.Time = time.Now()
 		} else {
-			f, err := os.Open(pn)
+			f, err := st.Open(pn)
 			if err != nil {
 				return err
 			}
@@ -150,6 +155,24 @@ func (c Cache) Subscribers() *PubEncrList {
 	return c.PubEncrList(AsnSubscribers)
 }
 
+// UserType returns the content of asn/user (e.g. "actual" or "forum").
+func (c Cache) UserType() string {
+	b := c.CacheBuffer(AsnUser).Buffer
+	if b == nil {
+		return ""
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// Visibility returns the content of asn/visibility (e.g. "subscribers").
+func (c Cache) Visibility() string {
+	b := c.CacheBuffer(AsnVisibility).Buffer
+	if b == nil {
+		return ""
+	}
+	return strings.TrimSpace(b.String())
+}
+
 type CacheEntry struct {
 	time.Time
 	Cacher
@@ -0,0 +1,45 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+// testCat returns the content of a cat of the given references.
+func testCat(t *testing.T, ses *Ses, refs ...string) (string, error) {
+	var req Req
+	return testAck(t, ses, ses.ExecCat(req, nil, refs...))
+}
+
+func TestExecCat(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	user := newTestUser(t, repos)
+	if _, err := testStore(repos, x, user, user, "a",
+		"hello world"); err != nil {
+		t.Fatal(err)
+	}
+	ses := newTestSes(repos, user)
+	for _, c := range []struct{ ref, out string }{
+		{"~/a", "hello world"},
+		{"~/a#6", "bytes 6-10/11\nworld"},
+		{"~/a#2+3", "bytes 2-4/11\nllo"},
+		{"~/a#6+100", "bytes 6-10/11\nworld"},
+		{"~/a#11", "bytes */11\n"},
+	} {
+		s, err := testCat(t, ses, c.ref)
+		if err != nil || s != c.out {
+			t.Errorf("%s: %q %v", c.ref, s, err)
+		}
+	}
+	if _, err := testCat(t, ses, "~/a#0+0"); err == nil {
+		t.Error("empty range")
+	}
+	if _, err := testCat(t, ses, "~/nosuch"); err == nil {
+		t.Error("cat nosuch")
+	}
+}
@@ -23,9 +23,14 @@ type Config struct {
 	// (e.g. "siren")
 	Dir string
 	// Local repository directory (e.g. /srv/asn/siren or siren.asn)
+	Storage string `yaml:"storage,omitempty"`
+	// Repository backend, "fs" (default) or "mem". The in-memory
+	// repository is lost on exit so it's only useful for tests and
+	// short-lived servers; its tmp files and uploads are in /dev/shm.
 	Lat float64 `yaml:"lat,omitempty"`
 	Lon float64 `yaml:"lon,omitempty"`
-	// Latitude and Longitude of this server or administrator.
+	// Latitude and Longitude of this server or administrator. Those of
+	// bridge servers are beyond +/-90 and back-end servers +/-180.
 	Listen []*URL `yaml:"listen,omitempty"`
 	// List of listening URLs.  All servers should listen to WebSockets
 	// (e.g. ws://). Servers should also listen on a Unix socket file for
@@ -42,6 +47,30 @@ type Config struct {
 	Keys *ServiceKeys `yaml:"keys,omitempty"`
 	// Usually generated with -new-keys then edited to remove the
 	// unnecessary secrete keys.
+	Quota Quotas `yaml:"quota,omitempty"`
+	// Server limits of bytes and blobs authored by each user keyed by
+	// user key, user type (actual, bridge, forum or place) or default.
+	Retain Retentions `yaml:"retain,omitempty"`
+	// Server rules to periodically remove old blobs, e.g.
+	//	- type: forum
+	//	  name: asn/messages/
+	//	  age: 90d
+	//	- name: news/
+	//	  keep: 50
+	// Keys, lists, history and pending moderation are never removed.
+	GC *GCConfig `yaml:"gc,omitempty"`
+	// Server garbage collection schedule, e.g.
+	//	interval: 24h
+	//	grace: 1h
+	History *HistoryConfig `yaml:"history,omitempty"`
+	// Server limits of the replaced versions kept for each named blob,
+	// e.g.
+	//	keep: 10
+	//	age: 30d
+	// Without this, the latest 10 are kept; with neither, all are kept.
+	UserCache int `yaml:"user-cache,omitempty"`
+	// Server limit of resident user caches; zero is unlimited. Those of
+	// logged in users are always kept.
 }
 
 // Bytes marshals the Config for output to a file.
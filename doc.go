@@ -42,48 +42,118 @@ Examples:
   $ asn -config example-adm.yaml -server sf - <<-EOF
 	echo hello world
   EOF
+  $ asn -config example-sf.yaml fsck		# offline
+  $ asn -config example-sf.yaml export sf.archive
+  $ asn -config example-adm.yaml upload media/video - <video.mp4
 
 Commands:
 
   approve BLOB...
 	Before acknowledgment, the server forwards the matching blobs
-	to its owner or subscriber.
+	to its owner or subscriber or, if named, links them as the
+	current version.
   auth [-u USER] AUTH
 	Record user's ED255519 authentication key.
-  blob <USER|[USER/]NAME> - CONTENT
-	Creates named blob.
-  cat BLOB...
-	Returns the contents of the named blob.
+  blob [-a | -m SUM] <USER|[USER/]NAME> - CONTENT
+	Creates named blob; with -a, only if absent or, with -m,
+	only if the current version has SUM of at least 16 digits.
+  cat BLOB[#OFFSET[+LENGTH]]...
+	Returns the contents of the named blob; or, the LENGTH bytes,
+	or rest, from OFFSET preceded by a "bytes FIRST-LAST/SIZE" line.
+	LENGTH may not be zero.
   clone [NAME][@TIME]
 	Replicate or update an object repository.
+  du [USER...]
+	Returns the bytes and blobs authored by the session or, for the
+	admin, named users along with their quota.
   echo [STRING]...
 	Returns space separated ARGS in the Ack data.
+  export [@TIME] [FILE]
+	Write an archive of the blobs, or those after TIME, and their
+	links to the server's FILE or, without, the acknowledgment.
   filter FILTER [ARGS... --] [BLOB...]
 	Returns STDOUT of FILTER program run with list of blobs as STDIN.
   fetch BLOB...
 	Before acknowledgement the server sends all matching blobs.
-  gc [-v|--verbose] [-n|--dry-run] [@TIME]
-	Before acknowledgement the server purges older or all blobs
-	flagged for deletion.
+  fsck [-r|--repair]
+	Check the consistency of sum files, links and users; with
+	--repair, fix those problems that can be. Admin only.
+  gc [-v|--verbose] [-n|--dry-run] [-b|--before TIME]
+	Before acknowledgement the server purges all blobs, or those
+	older than TIME, that are flagged for deletion then returns
+	the number of blobs and bytes reclaimed. Unlike the @TIME of
+	other commands, this selects older blobs rather than newer.
+  history <[~USER/|/]NAME>...
+	Returns the time, sum and date of each recorded version of
+	the named blobs, latest first; the time may be used to read
+	the version current then with NAME@TIME.
   iam NAME
         Show NAME instead of LOGIN key in list of Who.
 	Used by servers in indirect clone request.
-  ls [BLOB...]
-	Returns list of matching blobs.
+  import [@TIME] <FILE | ->
+	Verify and store the blobs, or those after TIME, of an archive
+	then restore its missing links.
+  invite BRIDGE USER...
+	Add USERs to those that receive BRIDGE messages while
+	signed-in to a bridge server.
+  journal [CURSOR]
+	Returns the repos changes after CURSOR, each preceded by the
+	CURSOR that follows it. Changes before the last checkpoint
+	are discarded so these begin with that checkpoint.
+  ls [-l] [-t] [-r] [-n COUNT] [BLOB...]
+	Returns list of matching blobs; with -l, each with its sum,
+	size, owner, author and time. These are ordered by name or,
+	with -t, latest first; -r reverses the order and -n limits
+	the list to the first COUNT.
   mark [-u USER] [LATITUDE LONGITUDE | 7?PLACE]
-	Record user's location.
+	Record user's location; this is only sent to those permitted
+	by the user's asn/visibility: "public", "subscribers" or
+	"nobody".
+  members BRIDGE
+	List the invitees of BRIDGE and whether each is signed-in.
   newuser <"actual"|"bridge"|"forum"|"place">
 	Creates a new user and return keys in acknowledgment.
   objdump BLOB...
 	Returns the decoded header of the named blob
+  pending [OWNER]
+	Returns the messages awaiting approval by the moderators of
+	OWNER, or the session user, oldest first in the long format
+	of ls.
+  reject BLOB... - REASON
+	Remove the matching messages from their moderation queue and
+	send the REASON, or the first line of input, to each author.
+  retain [-n|--dry-run]
+	Remove, or just list, the blobs expired by the server's
+	retention rules.
   rm BLOB...
-	Flag blobs for removal by garbage collector.
+	Flag blobs for removal by garbage collector; removing a
+	listed key, OWNER/asn/LIST/KEY, also drops it from the list
+	or rewrites a whole OWNER/asn/LIST without it.
   trace [COMMAND [ARG]]
 	Return and flush the PDU trace or manipulate its filter.
+  txn - <<USER|[USER/]NAME> SIZE NL CONTENT>...
+	Store and link all of the named blobs, each with a line of
+	its name and SIZE followed by SIZE bytes of content, or none
+	of them; then return their sums.
+  unwatch [GLOB...]
+	Remove the session's matching watches or, without GLOB, all.
+  upload <<USER|[USER/]NAME> SIZE | ID [SUM | OFFSET - CHUNK]>
+	Begin the upload of a named blob of SIZE bytes and return
+	its ID and offset, or with ID alone, return those of an
+	interrupted upload; then send each CHUNK at OFFSET to return
+	the next; then store the completed upload if its content has
+	SUM. The client sends "upload NAME -" this way, printing the
+	ID to stderr, and resumes an interrupted upload with
+	"upload ID -".
   users
 	List all users.
   vouch USER SIG
 	Vouch for or deny USER's identity.
+  watch [GLOB...]
+	Push new blobs with names matching GLOB, [~<'*' | USER>/]NAME
+	or /NAME, to this session until it's unwatched or closed;
+	without GLOB, return the session's watches. Marks are never
+	pushed and messages only to their recipients.
   who
 	List logged in user names, if set, or login key.
 
@@ -96,6 +166,24 @@ Where BLOB may be any of the following:
 Server CONFIG Format:
   name: STRING
   dir: PATH
+  storage: <fs | mem>
+  user-cache: INT
+  history:
+    keep: INT
+    age: AGE
+  quota:
+    <USER | TYPE | default>:
+      bytes: INT
+      blobs: INT
+  retain:
+  - type: TYPE
+    name: GLOB[/]
+    age: AGE
+    keep: INT
+  gc:
+    interval: AGE
+    grace: AGE
+    batch: INT
   lat: FLOAT
   lon: FLOAT
   listen:
@@ -116,6 +204,13 @@ Server CONFIG Format:
         auth: XXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXX
     nonce: XXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXX
 
+Where AGE is a duration (e.g. 36h) or number of days (e.g. 7d); TYPE is
+the user type of actual, bridge, forum or place; quota limits the bytes
+and number of blobs by each author; retain removes the owner's blobs
+matching GLOB, or everything within GLOB/, that are older than AGE or
+beyond the latest INT; and gc removes unlinked blobs every interval that
+are older than grace, pausing after each batch.
+
 Admin CONFIG Format:
   name: STRING
   dir: PATH
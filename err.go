@@ -21,6 +21,8 @@ const (
 	UnexpectedErr
 	UnknownErr
 	UnsupportedErr
+	QuotaErr
+	ConflictErr
 
 	Nerrors
 
@@ -38,6 +40,8 @@ const (
 	UnexpectedV0
 	UnknownV0
 	UnsupportedV0
+	QuotaV0
+	ConflictV0
 )
 
 var (
@@ -56,6 +60,8 @@ var (
 	ErrUnexpected   = errors.New("Unexpected PDU")
 	ErrUnknown      = errors.New("Unknown PDU")
 	ErrUnsupported  = errors.New("Unsupported PDU")
+	ErrQuota        = errors.New("Quota exceeded")
+	ErrConflict     = errors.New("Conflicting version")
 
 	ErrStrings = [Nerrors]string{
 		Success:         "Success",
@@ -68,6 +74,8 @@ var (
 		UnexpectedErr:   "UnexpectedErr",
 		UnknownErr:      "UnknownErr",
 		UnsupportedErr:  "UnsupportedErr",
+		QuotaErr:        "QuotaErr",
+		ConflictErr:     "ConflictErr",
 	}
 
 	Errors = [Nerrors]error{
@@ -81,6 +89,8 @@ var (
 		UnexpectedErr:   ErrUnexpected,
 		UnknownErr:      ErrUnknown,
 		UnsupportedErr:  ErrUnsupported,
+		QuotaErr:        ErrQuota,
+		ConflictErr:     ErrConflict,
 	}
 
 	VerErr = [(Latest + 1) * MaxErr]Err{
@@ -94,6 +104,8 @@ var (
 		((0 * MaxErr) | UnexpectedV0):   UnexpectedErr,
 		((0 * MaxErr) | UnknownV0):      UnknownErr,
 		((0 * MaxErr) | UnsupportedV0):  UnsupportedErr,
+		((0 * MaxErr) | QuotaV0):        QuotaErr,
+		((0 * MaxErr) | ConflictV0):     ConflictErr,
 	}
 
 	ErrVer = [(Latest + 1) * MaxErr]Err{
@@ -107,6 +119,8 @@ var (
 		((0 * MaxErr) | UnexpectedErr):   UnexpectedV0,
 		((0 * MaxErr) | UnknownErr):      UnknownV0,
 		((0 * MaxErr) | UnsupportedErr):  UnsupportedV0,
+		((0 * MaxErr) | QuotaErr):        QuotaV0,
+		((0 * MaxErr) | ConflictErr):     ConflictV0,
 	}
 )
 
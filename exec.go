@@ -13,8 +13,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/apptimistco/asn/debug"
@@ -25,68 +26,150 @@ import (
 const (
 	ExecApproveUsage = `approve BLOB...`
 	ExecAuthUsage    = `auth [-u USER] AUTH`
-	ExecBlobUsage    = `blob <USER|[USER/]NAME> - CONTENT`
-	ExecCatUsage     = `cat BLOB...`
+	ExecBlobUsage    = `blob [-a | -m SUM] <USER|[USER/]NAME> - CONTENT`
+	ExecCatUsage     = `cat BLOB[#OFFSET[+LENGTH]]...`
 	ExecCloneUsage   = `clone [NAME][@TIME]`
 	ExecEchoUsage    = `echo [STRING]...`
+	ExecExportUsage  = `export [@TIME] [FILE]`
 	ExecDumpUsage    = `dump BLOB...`
+	ExecDUUsage      = `du [USER...]`
 	ExecFetchUsage   = `fetch BLOB...`
 	ExecFilterUsage  = `filter FILTER [ARGS... --] [BLOB...]`
-	ExecGCUsage      = `gc [-v|--verbose] [-n|--dry-run] [@TIME]`
+	ExecFsckUsage    = `fsck [-r|--repair]`
+	ExecGCUsage      = `gc [-v|--verbose] [-n|--dry-run] [-b|--before TIME]`
+	ExecHistoryUsage = `history <[~USER/|/]NAME>...`
 	ExecIamUsage     = `iam NAME`
-	ExecLSUsage      = `ls [BLOB...]`
+	ExecImportUsage  = `import [@TIME] <FILE | ->`
+	ExecInviteUsage  = `invite BRIDGE USER...`
+	ExecJournalUsage = `journal [CURSOR]`
+	ExecLSUsage      = `ls [-l] [-t] [-r] [-n COUNT] [BLOB...]`
 	ExecMarkUsage    = `mark [-u USER] [LATITUDE LONGITUDE | 7?PLACE]`
+	ExecMembersUsage = `members BRIDGE`
 	ExecNewUserUsage = `newuser [-b] <"actual"|"bridge"|"forum"|"place">`
 	ExecObjDumpUsage = `objdump BLOB...`
+	ExecPendingUsage = `pending [OWNER]`
+	ExecRejectUsage  = `reject BLOB... - REASON`
+	ExecRetainUsage  = `retain [-n|--dry-run]`
 	ExecRMUsage      = `rm BLOB...`
 	ExecTraceUsage   = `trace [COMMAND [ARG]]`
+	ExecTxnUsage     = `txn - <<USER|[USER/]NAME> SIZE NL CONTENT>...`
+	ExecUnwatchUsage = `unwatch [GLOB...]`
+	ExecUploadUsage  = `upload <<USER|[USER/]NAME> SIZE | ID [SUM | OFFSET - CHUNK]>`
 	ExecUsersUsage   = `users`
 	ExecVouchUsage   = `vouch USER SIG`
+	ExecWatchUsage   = `watch [GLOB...]`
 	ExecWhoUsage     = `who`
 
 	ExecUsage = `Commands:
 
   ` + ExecApproveUsage + `
 	Before acknowledgment, the server forwards the matching blobs
-	to its owner or subscriber.
+	to its owner or subscriber or, if named, links them as the
+	current version.
   ` + ExecAuthUsage + `
 	Record user's ED255519 authentication key.
   ` + ExecBlobUsage + `
-	Creates named blob.
+	Creates named blob; with -a, only if absent or, with -m,
+	only if the current version has SUM of at least 16 digits.
   ` + ExecCatUsage + `
-	Returns the contents of the named blobs *without* headers.
+	Returns the contents of the named blobs *without* headers;
+	or, the LENGTH bytes, or rest, of each from OFFSET preceded
+	by a "bytes FIRST-LAST/SIZE" line. LENGTH may not be zero.
   ` + ExecCloneUsage + `
 	Replicate or update an object repository.
   ` + ExecDumpUsage + `
 	Returns the concatenation of the named blobs *with* headers.
+  ` + ExecDUUsage + `
+	Returns the bytes and blobs authored by the session or, for the
+	admin, named users along with their quota.
   ` + ExecEchoUsage + `
 	Returns space separated ARGS in the Ack data.
+  ` + ExecExportUsage + `
+	Write an archive of the blobs, or those after TIME, and their
+	links to the server's FILE or, without, the acknowledgment.
   ` + ExecFilterUsage + `
 	Returns STDOUT of FILTER program run with list of blobs as STDIN.
   ` + ExecFetchUsage + `
 	Before acknowledgement the server sends all matching blobs.
+  ` + ExecFsckUsage + `
+	Check the consistency of sum files, links and users; with
+	--repair, fix those problems that can be. Admin only.
   ` + ExecGCUsage + `
-	Before acknowledgement the server purges older or all blobs
-	flagged for deletion.
+	Before acknowledgement the server purges all blobs, or those
+	older than TIME, that are flagged for deletion then returns
+	the number of blobs and bytes reclaimed. Unlike the @TIME of
+	other commands, this selects older blobs rather than newer.
+  ` + ExecHistoryUsage + `
+	Returns the time, sum and date of each recorded version of
+	the named blobs, latest first; the time may be used to read
+	the version current then with NAME@TIME.
   ` + ExecIamUsage + `
         Show NAME instead of LOGIN key in list of Who.
 	Used by servers in indirect clone request.
+  ` + ExecImportUsage + `
+	Verify and store the blobs, or those after TIME, of an archive
+	then restore its missing links.
+  ` + ExecInviteUsage + `
+	Add USERs to those that receive BRIDGE messages while
+	signed-in to a bridge server.
+  ` + ExecJournalUsage + `
+	Returns the repos changes after CURSOR, each preceded by the
+	CURSOR that follows it. Changes before the last checkpoint
+	are discarded so these begin with that checkpoint.
   ` + ExecLSUsage + `
-	Returns list of matching blobs.
+	Returns list of matching blobs; with -l, each with its sum,
+	size, owner, author and time. These are ordered by name or,
+	with -t, latest first; -r reverses the order and -n limits
+	the list to the first COUNT.
   ` + ExecMarkUsage + `
-	Record user's location.
+	Record user's location; this is only sent to those permitted
+	by the user's asn/visibility: "public", "subscribers" or
+	"nobody".
+  ` + ExecMembersUsage + `
+	List the invitees of BRIDGE and whether each is signed-in.
   ` + ExecNewUserUsage + `
 	Creates a new user and return keys in acknowledgment.
   ` + ExecObjDumpUsage + `
 	Returns the decoded header of the named blob
+  ` + ExecPendingUsage + `
+	Returns the messages awaiting approval by the moderators of
+	OWNER, or the session user, oldest first in the long format
+	of ls.
+  ` + ExecRejectUsage + `
+	Remove the matching messages from their moderation queue and
+	send the REASON, or the first line of input, to each author.
+  ` + ExecRetainUsage + `
+	Remove, or just list, the blobs expired by the server's
+	retention rules.
   ` + ExecRMUsage + `
-	Flag blobs for removal by garbage collector.
+	Flag blobs for removal by garbage collector; removing a
+	listed key, OWNER/asn/LIST/KEY, also drops it from the list
+	or rewrites a whole OWNER/asn/LIST without it.
   ` + ExecTraceUsage + `
 	Return and flush the PDU trace or manipulate its filter.
+  ` + ExecTxnUsage + `
+	Store and link all of the named blobs, each with a line of
+	its name and SIZE followed by SIZE bytes of content, or none
+	of them; then return their sums.
+  ` + ExecUnwatchUsage + `
+	Remove the session's matching watches or, without GLOB, all.
+  ` + ExecUploadUsage + `
+	Begin the upload of a named blob of SIZE bytes and return
+	its ID and offset, or with ID alone, return those of an
+	interrupted upload; then send each CHUNK at OFFSET to return
+	the next; then store the completed upload if its content has
+	SUM. The client sends "upload NAME -" this way, printing the
+	ID to stderr, and resumes an interrupted upload with
+	"upload ID -".
   ` + ExecUsersUsage + `
 	List all users.
   ` + ExecVouchUsage + `
 	Vouch for or deny USER's identity.
+  ` + ExecWatchUsage + `
+	Push new blobs with names matching GLOB, [~<'*' | USER>/]NAME
+	or /NAME, to this session until it's unwatched or closed;
+	without GLOB, return the session's watches. Marks are never
+	pushed and messages only to their recipients.
   ` + ExecWhoUsage + `
 	List logged in user names, if set, or login key.
 
@@ -101,7 +184,7 @@ Where BLOB may be any of the following:
 func (ses *Ses) RxExec(pdu *PDU) error {
 	var (
 		req  Req
-		cmd  [256]byte
+		cmd  [256 + BlobNameMax]byte
 		args []string
 	)
 	req.ReadFrom(pdu)
@@ -153,32 +236,62 @@ func (ses *Ses) Exec(req Req, in ReadWriteToer, args ...string) interface{} {
 		return ses.ExecClone(args[1:]...)
 	case "dump":
 		return ses.ExecDump(req, in, args[1:]...)
+	case "du":
+		return ses.ExecDU(args[1:]...)
 	case "echo":
 		return strings.Join(args[1:], " ") + "\n"
+	case "export":
+		return ses.ExecExport(req, args[1:]...)
 	case "fetch":
 		return ses.ExecFetch(in, args[1:]...)
 	case "filter":
 		return ses.ExecFilter(req, in, args[1:]...)
+	case "fsck":
+		return ses.ExecFsck(args[1:]...)
 	case "gc":
 		return ses.ExecGC(req, args[1:]...)
+	case "history":
+		return ses.ExecHistory(args[1:]...)
 	case "iam":
 		return ses.ExecIam(args[1:]...)
+	case "import":
+		return ses.ExecImport(in, args[1:]...)
+	case "invite":
+		return ses.ExecInvite(args[1:]...)
+	case "journal":
+		return ses.ExecJournal(args[1:]...)
 	case "ls":
 		return ses.ExecLS(req, in, args[1:]...)
 	case "mark":
 		return ses.ExecMark(args[1:]...)
+	case "members":
+		return ses.ExecMembers(args[1:]...)
 	case "newuser":
 		return ses.ExecNewUser(args[1:]...)
 	case "objdump":
 		return ses.ExecObjDump(in, args[1:]...)
+	case "pending":
+		return ses.ExecPending(args[1:]...)
+	case "reject":
+		return ses.ExecReject(in, args[1:]...)
+	case "retain":
+		return ses.ExecRetain(args[1:]...)
 	case "rm":
 		return ses.ExecRM(in, args[1:]...)
 	case "trace":
 		return ses.ExecTrace(args[1:]...)
+	case "txn":
+		return ses.ExecTxn(in, args[1:]...)
+	case "unwatch":
+		return ses.ExecUnwatch(args[1:]...)
+	case "upload":
+		return ses.ExecUpload(in, args[1:]...)
 	case "users":
 		return ses.ExecUsers(args[1:]...)
 	case "vouch":
 		return ses.ExecVouch(args[1:]...)
+	case "watch":
+		return ses.ExecWatch(args[1:]...)
 	case "who":
 		return ses.ExecWho(req, args[1:]...)
 	}
@@ -194,7 +307,7 @@ func (ses *Ses) ExecApprove(r io.Reader, args ...string) interface{} {
 	defer func() { sums = nil }()
 	err := ses.Blobber(func(fn string) error {
 		// Permission is checked in repos.Approvals()
-		f, err := os.Open(fn)
+		f, err := ses.open(fn)
 		if err != nil {
 			return err
 		}
@@ -241,44 +354,77 @@ func (ses *Ses) ExecAuth(args ...string) interface{} {
 	return sum
 }
 
-func (ses *Ses) ExecBlob(in ReadWriteToer, args ...string) interface{} {
-	owner := ses.user
-	if len(args) < 2 {
-		return &Usage{ExecBlobUsage}
-	}
-	name := args[0]
-	switch args[0][0] {
+// blobOwner returns the owner and name of a blob argument that the session
+// user may write.
+func (ses *Ses) blobOwner(arg string) (owner *User, name string, err error) {
+	owner = ses.user
+	name = arg
+	switch arg[0] {
 	case '/':
 		admin := ses.asn.repos.users.User(ses.cfg.Keys.Admin.Pub.Encr)
 		if owner != admin {
-			return os.ErrPermission
+			return nil, "", os.ErrPermission
 		}
 		owner = ses.asn.repos.users.User(ses.cfg.Keys.Server.Pub.Encr)
-		name = args[0][1:]
+		name = arg[1:]
 	case '~':
-		slash := strings.Index(args[0][:], "/")
+		slash := strings.Index(arg[:], "/")
 		if slash < 0 {
 			slash = len(name)
 			name = ""
 		} else {
-			name = args[0][slash+1:]
+			name = arg[slash+1:]
 		}
-		owner = ses.asn.repos.users.UserString(args[0][1:slash])
+		owner = ses.asn.repos.users.UserString(arg[1:slash])
 		if owner == nil {
-			return ErrNOENT
+			return nil, "", ErrNOENT
 		}
 	}
-	var sum *Sum
-	err := ses.asn.repos.Permission(owner, ses.user, name)
+	err = ses.asn.repos.Permission(owner, ses.user, name)
+	return
+}
+
+func (ses *Ses) ExecBlob(in ReadWriteToer, args ...string) interface{} {
+	var (
+		cond bool
+		cur  string
+	)
+	for len(args) > 0 && (args[0] == "-a" || args[0] == "-m") {
+		cond = true
+		if args[0] == "-m" {
+			if len(args) < 2 || len(args[1]) < StoreIfSumMin ||
+				!IsHex(args[1]) {
+				return &Usage{ExecBlobUsage}
+			}
+			cur = args[1]
+			args = args[1:]
+		}
+		args = args[1:]
+	}
+	if len(args) < 2 || args[0] == "" {
+		return &Usage{ExecBlobUsage}
+	}
+	var (
+		sum *Sum
+		wt  WriteToer
+	)
+	owner, name, err := ses.blobOwner(args[0])
 	if err != nil {
 		return err
 	}
 	if args[1] == "-" {
 		ses.asn.Fixmef("%T\n", in)
-		sum, err = ses.Store(owner, ses.user, name, in)
+		wt = in
+	} else {
+		wt = bytes.NewBufferString(strings.Join(args[1:], " "))
+	}
+	if cond {
+		blob := NewBlobWith(&owner.key, &ses.user.key, name,
+			ses.asn.time.out)
+		defer blob.Free()
+		sum, err = ses.asn.repos.StoreIf(ses, cur, Latest, blob, wt)
 	} else {
-		sum, err = ses.Store(owner, ses.user, name,
-			bytes.NewBufferString(strings.Join(args[1:], " ")))
+		sum, err = ses.Store(owner, ses.user, name, wt)
 	}
 	if err != nil {
 		return err
@@ -290,52 +436,104 @@ func (ses *Ses) ExecBlob(in ReadWriteToer, args ...string) interface{} {
 }
 
 func (ses *Ses) ExecCat(req Req, r io.Reader, args ...string) interface{} {
+	var refs []string
 	if len(args) == 0 {
 		return &Usage{ExecCatUsage}
 	}
+	for _, arg := range args {
+		switch arg {
+		case "":
+			// trails the "-" separator
+		case "-":
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				refs = append(refs, scanner.Text())
+			}
+		default:
+			refs = append(refs, arg)
+		}
+	}
+	for _, ref := range refs {
+		if rng, _ := StripRange(ref); rng != nil && rng.Len == 0 {
+			return &Error{ref, "empty range"}
+		}
+	}
 	ack, err := ses.asn.NewAckSuccessPDUFile(req)
 	if err != nil {
 		return err
 	}
-	err = ses.Blobber(func(fn string) error {
-		if strings.HasSuffix(fn, filepath.FromSlash(AsnMark)) {
-			user, _ := ses.asn.repos.ParsePath(fn)
-			if user == nil {
-				return os.ErrNotExist
-			}
-			_, err := user.cache.Mark().WriteTo(ack)
+	for _, ref := range refs {
+		rng, arg := StripRange(ref)
+		err = ses.Blobber(func(fn string) error {
+			return ses.cat(ack, fn, rng)
+		}, nil, arg)
+		if err != nil {
+			ack.Free()
+			ack = nil
+			return err
+		}
+	}
+	return ack
+}
+
+// cat writes the content of the named blob, or its range preceded by a line
+// of "bytes FIRST-LAST/SIZE", to the ack.
+func (ses *Ses) cat(ack *PDU, fn string, rng *Range) error {
+	var (
+		r    io.ReadSeeker
+		size int64
+	)
+	if strings.HasSuffix(fn, filepath.FromSlash(AsnMark)) {
+		user, _ := ses.asn.repos.ParsePath(fn)
+		if user == nil {
+			return os.ErrNotExist
+		}
+		if !ses.asn.repos.MarkVisible(user, ses.user) {
+			return os.ErrPermission
+		}
+		b := &bytes.Buffer{}
+		if _, err := user.cache.Mark().WriteTo(b); err != nil {
 			return err
 		}
-		f, err := os.Open(fn)
+		r, size = bytes.NewReader(b.Bytes()), int64(b.Len())
+	} else {
+		f, err := ses.open(fn)
 		if err != nil {
 			return err
 		}
 		defer f.Close()
-		if _, err = BlobSeek(f); err != nil {
+		off, err := BlobSeek(f)
+		if err != nil {
 			return err
 		}
-		ack.ReadFrom(f)
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		r, size = f, fi.Size()-off
+	}
+	if rng == nil {
+		_, err := ack.ReadFrom(r)
+		return err
+	}
+	off, n := rng.Clip(size)
+	if n == 0 {
+		fmt.Fprintf(ack, "bytes */%d\n", size)
 		return nil
-	}, r, args...)
-	if err != nil {
-		ack.Free()
-		ack = nil
+	}
+	fmt.Fprintf(ack, "bytes %d-%d/%d\n", off, off+n-1, size)
+	if _, err := r.Seek(off, os.SEEK_CUR); err != nil {
 		return err
 	}
-	return ack
+	_, err := ack.ReadFrom(io.LimitReader(r, n))
+	return err
 }
 
 func (ses *Ses) ExecClone(args ...string) interface{} {
 	if ses.asnsrv {
 		return &Error{args[0], "won't run with offline server"}
 	}
-	var (
-		err   error
-		after time.Time
-
-		dir, subdir []os.FileInfo
-	)
-	const fnlen = (SumSz - 1) * 2
+	var after time.Time
 	nargs := len(args)
 	if nargs > 1 {
 		return &Usage{ExecCloneUsage}
@@ -346,29 +544,14 @@ func (ses *Ses) ExecClone(args ...string) interface{} {
 			return ses.execCloneRemote(after, name)
 		}
 	}
-	if dir, err = ioutil.ReadDir(ses.cfg.Dir); err != nil {
-		return err
-	}
-	defer func() { dir = nil }()
-	for _, fi := range dir {
-		if fi.IsDir() && len(fi.Name()) == 2 {
-			subdn := filepath.Join(ses.cfg.Dir, fi.Name())
-			if subdir, err = ioutil.ReadDir(subdn); err != nil {
-				return err
-			}
-			for _, fi := range subdir {
-				fn := filepath.Join(subdn, fi.Name())
-				if !fi.IsDir() && len(fi.Name()) == fnlen {
-					bt := BlobTime(fn)
-					if after.IsZero() || bt.After(after) {
-						ses.asn.Tx(NewPDUFN(fn))
-					}
-				}
-			}
-			subdir = nil
+	return ses.asn.repos.Filter(after, func(fn string) error {
+		f, err := ses.asn.repos.Open(fn)
+		if err != nil {
+			return err
 		}
-	}
-	return nil
+		ses.asn.Tx(NewPDUFile(f))
+		return nil
+	})
 }
 
 func (ses *Ses) execCloneRemote(after time.Time, name string) interface{} {
@@ -433,7 +616,7 @@ func (ses *Ses) ExecDump(req Req, r io.Reader, args ...string) interface{} {
 		return err
 	}
 	err = ses.Blobber(func(fn string) error {
-		f, err := os.Open(fn)
+		f, err := ses.open(fn)
 		if err != nil {
 			return err
 		}
@@ -449,6 +632,67 @@ func (ses *Ses) ExecDump(req Req, r io.Reader, args ...string) interface{} {
 	return ack
 }
 
+func (ses *Ses) ExecDU(args ...string) interface{} {
+	users := []*User{ses.user}
+	if len(args) > 0 {
+		users = users[:0]
+		for _, arg := range args {
+			if arg == "-help" || arg == "--help" {
+				return &Usage{ExecDUUsage}
+			}
+			user := ses.asn.repos.users.UserString(strings.TrimPrefix(arg,
+				"~"))
+			if user == nil {
+				return &Error{arg, "no such user"}
+			}
+			users = append(users, user)
+		}
+	}
+	admin := ses.asn.repos.users.User(ses.cfg.Keys.Admin.Pub.Encr)
+	for _, user := range users {
+		if user != ses.user && ses.user != admin {
+			return os.ErrPermission
+		}
+	}
+	b := &bytes.Buffer{}
+	if err := ses.asn.repos.DU(b, users...); err != nil {
+		return err
+	}
+	return b
+}
+
+func (ses *Ses) ExecExport(req Req, args ...string) interface{} {
+	var after time.Time
+	if len(args) > 0 && strings.HasPrefix(args[0], "@") {
+		after, _ = ses.StripTime(args[0])
+		args = args[1:]
+	}
+	if len(args) > 1 {
+		return &Usage{ExecExportUsage}
+	}
+	if ses.user != ses.asn.repos.users.User(ses.cfg.Keys.Admin.Pub.Encr) {
+		return os.ErrPermission
+	}
+	if len(args) == 1 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return ses.asn.repos.Export(f, after)
+	}
+	ack, err := ses.asn.NewAckSuccessPDUFile(req)
+	if err != nil {
+		return err
+	}
+	if err = ses.asn.repos.Export(ack, after); err != nil {
+		ack.Free()
+		ack = nil
+		return err
+	}
+	return ack
+}
+
 func (ses *Ses) ExecFetch(r io.Reader, args ...string) interface{} {
 	var err error
 	if len(args) < 1 {
@@ -459,7 +703,11 @@ func (ses *Ses) ExecFetch(r io.Reader, args ...string) interface{} {
 	}
 	err = ses.Blobber(func(fn string) error {
 		ses.asn.Log("sending:", fn)
-		ses.asn.Tx(NewPDUFN(fn))
+		f, err := ses.open(fn)
+		if err != nil {
+			return err
+		}
+		ses.asn.Tx(NewPDUFile(f))
 		return nil
 	}, r, args...)
 	return err
@@ -506,7 +754,7 @@ func (ses *Ses) ExecFilter(req Req, r io.Reader, args ...string) interface{} {
 	go func() {
 		defer cmdStdin.Close()
 		blobberErr <- ses.Blobber(func(fn string) error {
-			f, err := os.Open(fn)
+			f, err := ses.open(fn)
 			if err != nil {
 				return err
 			}
@@ -537,23 +785,48 @@ func (ses *Ses) ExecFilter(req Req, r io.Reader, args ...string) interface{} {
 	return ack
 }
 
+func (ses *Ses) ExecFsck(args ...string) interface{} {
+	var repair bool
+	for _, arg := range args {
+		switch arg {
+		case "-r", "--repair":
+			repair = true
+		default:
+			return &Usage{ExecFsckUsage}
+		}
+	}
+	if ses.user != ses.asn.repos.users.User(ses.cfg.Keys.Admin.Pub.Encr) {
+		return os.ErrPermission
+	}
+	b := &bytes.Buffer{}
+	if err := ses.asn.repos.Fsck(ses, ses.user, b, repair); err != nil {
+		return err
+	}
+	return b
+}
+
 func (ses *Ses) ExecGC(req Req, args ...string) interface{} {
 	var (
 		err     error
-		after   time.Time
+		before  time.Time
 		verbose bool
 		dryrun  bool
 		ack     *PDU
+		w       io.Writer
 	)
-	for _, arg := range args {
-		switch {
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
 		case arg == "-v" || arg == "--verbose":
 			verbose = true
 		case arg == "-n" || arg == "--dry-run":
 			dryrun = true
-		case strings.HasPrefix(arg, "@"):
-			after, _ = ses.StripTime(arg)
-		case arg == "-help" || arg == "--help":
+		case (arg == "-b" || arg == "--before") && i+1 < len(args):
+			i += 1
+			before, _ = ses.StripTime("@" + args[i])
+			if before.IsZero() {
+				return &Error{args[i], "invalid time"}
+			}
+		default:
 			return &Usage{ExecGCUsage}
 		}
 	}
@@ -562,35 +835,59 @@ func (ses *Ses) ExecGC(req Req, args ...string) interface{} {
 		if err != nil {
 			return err
 		}
+		w = ack
 	}
-	err = ses.asn.repos.Filter(after, func(fn string) error {
-		var st syscall.Stat_t
-		if strings.HasSuffix(fn, filepath.FromSlash(AsnMark)) {
-			return nil
-		}
-		if err := syscall.Stat(fn, &st); err != nil {
-			return err
-		}
-		if st.Nlink == 1 {
-			if verbose {
-				fmt.Fprintf(ack, "removed `%s'\n", fn)
-			}
-			if dryrun {
-				fmt.Fprintf(ack, "Would removed `%s'\n", fn)
-			} else {
-				syscall.Unlink(fn)
-			}
-		}
-		return nil
-	})
+	stats, err := ses.asn.repos.GC(w, before, dryrun)
 	if err != nil {
 		ack.Free()
 		ack = nil
 		return err
 	}
+	ses.asn.Log("gc", stats)
+	if ack == nil {
+		return stats.String() + "\n"
+	}
+	fmt.Fprintln(ack, stats)
 	return ack
 }
 
+func (ses *Ses) ExecHistory(args ...string) interface{} {
+	if len(args) == 0 {
+		return &Usage{ExecHistoryUsage}
+	}
+	b := &bytes.Buffer{}
+	for _, arg := range args {
+		owner, name := ses.user, arg
+		switch {
+		case arg == "":
+			return &Usage{ExecHistoryUsage}
+		case arg[0] == '/':
+			owner = ses.asn.repos.users.User(ses.cfg.Keys.Server.Pub.Encr)
+			name = arg[1:]
+		case arg[0] == '~':
+			slash := strings.Index(arg, "/")
+			if slash < 0 {
+				return &Usage{ExecHistoryUsage}
+			}
+			var err error
+			owner, err = ses.asn.repos.users.Search(arg[1:slash])
+			if err != nil {
+				return err
+			} else if owner == nil {
+				return ErrNOENT
+			}
+			name = arg[slash+1:]
+		}
+		if len(args) > 1 {
+			fmt.Fprintln(b, arg+":")
+		}
+		if err := ses.asn.repos.History(b, owner, name); err != nil {
+			return err
+		}
+	}
+	return b
+}
+
 func (ses *Ses) ExecIam(args ...string) interface{} {
 	if len(args) != 1 {
 		return &Usage{ExecIamUsage}
@@ -599,18 +896,161 @@ func (ses *Ses) ExecIam(args ...string) interface{} {
 	return nil
 }
 
+func (ses *Ses) ExecImport(in io.Reader, args ...string) interface{} {
+	var after time.Time
+	if len(args) > 0 && strings.HasPrefix(args[0], "@") {
+		after, _ = ses.StripTime(args[0])
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return &Usage{ExecImportUsage}
+	}
+	if ses.user != ses.asn.repos.users.User(ses.cfg.Keys.Admin.Pub.Encr) {
+		return os.ErrPermission
+	}
+	r := in
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	b := &bytes.Buffer{}
+	stats, err := ses.asn.repos.Import(ses, r, after, b)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(b, stats)
+	return b
+}
+
+func (ses *Ses) ExecInvite(args ...string) interface{} {
+	if len(args) < 2 {
+		return &Usage{ExecInviteUsage}
+	}
+	owner := ses.asn.repos.users.UserString(args[0])
+	if owner == nil {
+		return ErrNOENT
+	}
+	if owner.cache.UserType() != UserTypeBridge {
+		return &Error{args[0], "not a bridge"}
+	}
+	if err := ses.asn.repos.Permission(owner, ses.user,
+		AsnInvites); err != nil {
+		return err
+	}
+	for _, arg := range args[1:] {
+		user := ses.asn.repos.users.UserString(arg)
+		if user == nil {
+			return &Error{arg, "no such user"}
+		}
+		_, err := ses.Store(owner, ses.user,
+			AsnInvites+"/"+user.FullString(), &bytes.Buffer{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ses *Ses) ExecJournal(args ...string) interface{} {
+	var cursor int64
+	if len(args) > 1 {
+		return &Usage{ExecJournalUsage}
+	} else if len(args) == 1 {
+		if _, err := fmt.Sscan(args[0], &cursor); err != nil {
+			return &Usage{ExecJournalUsage}
+		}
+	}
+	if ses.user != ses.asn.repos.users.User(ses.cfg.Keys.Admin.Pub.Encr) {
+		return os.ErrPermission
+	}
+	b := &bytes.Buffer{}
+	if _, err := ses.asn.repos.Journal(b, cursor); err != nil {
+		return err
+	}
+	return b
+}
+
 func (ses *Ses) ExecLS(req Req, r io.Reader, args ...string) interface{} {
+	var (
+		long, bytime, reverse bool
+		limit                 int
+		l                     lsEntries
+	)
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		opts := args[0][1:]
+		args = args[1:]
+		for _, c := range opts {
+			switch c {
+			case 'l':
+				long = true
+			case 't':
+				bytime = true
+			case 'r':
+				reverse = true
+			case 'n':
+				if len(args) == 0 {
+					return &Usage{ExecLSUsage}
+				}
+				if _, err := fmt.Sscan(args[0], &limit); err != nil ||
+					limit < 0 {
+					return &Usage{ExecLSUsage}
+				}
+				args = args[1:]
+			default:
+				return &Usage{ExecLSUsage}
+			}
+		}
+	}
+	sorted := long || bytime || reverse || limit > 0
 	ack, err := ses.asn.NewAckSuccessPDUFile(req)
 	if err != nil {
 		return err
 	}
 	slogin := ses.Keys.Client.Login.FullString()
 	err = ses.Blobber(func(fn string) error {
-		if ref := ses.asn.repos.FN2Ref(slogin, fn); ref != "" {
+		ref := ses.asn.repos.FN2Ref(slogin, fn)
+		if ref == "" {
+			return nil
+		} else if !sorted {
 			fmt.Fprintln(ack, ref)
+			return nil
+		}
+		e := &lsEntry{ref: ref, fn: fn}
+		if bytime {
+			e.t, _ = ses.asn.repos.LinkTime(fn)
 		}
+		l = append(l, e)
 		return nil
 	}, r, args...)
+	if err == nil && sorted {
+		if bytime {
+			sort.Stable(lsByTime{l})
+		} else {
+			sort.Stable(l)
+		}
+		if reverse {
+			for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
+				l[i], l[j] = l[j], l[i]
+			}
+		}
+		if limit > 0 && limit < len(l) {
+			l = l[:limit]
+		}
+		for _, e := range l {
+			if long {
+				err = ses.asn.repos.lsLong(ack, e)
+			} else {
+				_, err = fmt.Fprintln(ack, e.ref)
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
 	if err != nil {
 		ack.Free()
 		ack = nil
@@ -619,8 +1059,6 @@ func (ses *Ses) ExecLS(req Req, r io.Reader, args ...string) interface{} {
 	return ack
 }
 
-// ExecMark without args (or just -u USER) sets the login or given
-// user sets mark to { 0.0, 0.0 } (in the Gulf of Guinea)
 func (ses *Ses) ExecMark(args ...string) interface{} {
 	var err error
 	defer func() {
@@ -670,6 +1108,25 @@ func (ses *Ses) ExecMark(args ...string) interface{} {
 	return sum
 }
 
+func (ses *Ses) ExecMembers(args ...string) interface{} {
+	if len(args) != 1 {
+		return &Usage{ExecMembersUsage}
+	}
+	owner := ses.asn.repos.users.UserString(args[0])
+	if owner == nil {
+		return ErrNOENT
+	}
+	if ses.asn.repos.Permission(owner, ses.user, AsnInvites) != nil &&
+		!ses.user.OnList(owner.cache.Invites()) {
+		return os.ErrPermission
+	}
+	b := &bytes.Buffer{}
+	if err := ses.asn.repos.Members(b, owner); err != nil {
+		return err
+	}
+	return b
+}
+
 func (ses *Ses) ExecNewUser(args ...string) interface{} {
 	var err error
 	defer func() {
@@ -745,7 +1202,7 @@ func (ses *Ses) ExecObjDump(r io.Reader, args ...string) interface{} {
 				ses.asn.Diag(debug.Depth(2), err)
 			}
 		}()
-		f, err := file.Open(fn)
+		f, err := ses.open(fn)
 		if err != nil {
 			return
 		}
@@ -764,6 +1221,108 @@ func (ses *Ses) ExecObjDump(r io.Reader, args ...string) interface{} {
 	return out
 }
 
+func (ses *Ses) ExecPending(args ...string) interface{} {
+	if len(args) > 1 {
+		return &Usage{ExecPendingUsage}
+	}
+	owner := ses.user
+	if len(args) == 1 && args[0] != "" {
+		var err error
+		if owner, err = ses.asn.repos.users.Search(args[0]); err != nil {
+			return err
+		} else if owner == nil {
+			return ErrNOENT
+		}
+	}
+	if owner != ses.user && !ses.user.MayApproveFor(owner) &&
+		ses.user != ses.asn.repos.users.User(ses.cfg.Keys.Admin.Pub.Encr) {
+		return os.ErrPermission
+	}
+	slogin := ses.Keys.Client.Login.FullString()
+	l, err := ses.asn.repos.Pending(slogin, owner)
+	if err != nil {
+		return err
+	}
+	b := &bytes.Buffer{}
+	for _, e := range l {
+		if err = ses.asn.repos.lsLong(b, e); err != nil {
+			return err
+		}
+	}
+	return b
+}
+
+func (ses *Ses) ExecReject(r io.Reader, args ...string) interface{} {
+	dash := len(args)
+	for i, arg := range args {
+		if arg == "-" {
+			dash = i
+			break
+		}
+	}
+	if dash < 1 || dash == len(args) {
+		return &Usage{ExecRejectUsage}
+	}
+	reason := strings.Join(args[dash+1:], " ")
+	if strings.TrimSpace(reason) == "" && r != nil {
+		// stdin is only read for the newline terminated REASON
+		line, err := bufio.NewReader(r).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		reason = line
+	}
+	// the reason is a single line before the sums
+	reason = strings.Join(strings.Fields(reason), " ")
+	if reason == "" {
+		return &Usage{ExecRejectUsage}
+	}
+	sums := make(Sums, 0)
+	defer func() { sums = nil }()
+	err := ses.Blobber(func(fn string) error {
+		// Permission is checked in repos.Rejections()
+		f, err := ses.open(fn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sums = append(sums, *NewSumOf(f))
+		return nil
+	}, nil, args[:dash]...)
+	if err != nil {
+		return err
+	}
+	b := bytes.NewBufferString(reason + "\n")
+	if _, err = sums.WriteTo(b); err != nil {
+		return err
+	}
+	sum, err := ses.Store(ses.user, ses.user, AsnRejections+"/", b)
+	if err != nil {
+		return err
+	}
+	return sum
+}
+
+func (ses *Ses) ExecRetain(args ...string) interface{} {
+	var dryrun bool
+	for _, arg := range args {
+		switch arg {
+		case "-n", "--dry-run":
+			dryrun = true
+		default:
+			return &Usage{ExecRetainUsage}
+		}
+	}
+	if ses.user != ses.asn.repos.users.User(ses.cfg.Keys.Admin.Pub.Encr) {
+		return os.ErrPermission
+	}
+	b := &bytes.Buffer{}
+	if _, err := ses.asn.repos.Retain(ses, b, dryrun); err != nil {
+		return err
+	}
+	return b
+}
+
 func (ses *Ses) ExecRM(r io.Reader, args ...string) interface{} {
 	buf := &bytes.Buffer{}
 	owner := ses.user
@@ -784,7 +1343,8 @@ func (ses *Ses) ExecRM(r io.Reader, args ...string) interface{} {
 						args = args[:i]
 					}
 					s = u.FullString()
-					os.RemoveAll(ses.asn.repos.Expand(s))
+					repos := ses.asn.repos
+					repos.storage.RemoveAll(repos.Expand(s))
 					ses.asn.repos.users.RM(u)
 					ses.asn.Log("removed user:", s)
 				} else {
@@ -798,14 +1358,20 @@ func (ses *Ses) ExecRM(r io.Reader, args ...string) interface{} {
 	if len(args) < 1 {
 		return nil
 	}
-	err := ses.Blobber(func(fn string) error {
+	args, sum, err := ses.unlistArgs(args)
+	if err != nil {
+		return err
+	} else if len(args) < 1 {
+		return sum
+	}
+	err = ses.Blobber(func(fn string) error {
 		fmt.Fprintln(buf, ses.asn.repos.DePrefix(fn))
 		return nil
 	}, r, args...)
 	if err != nil {
 		return err
 	}
-	sum, err := ses.Store(owner, ses.user, AsnRemovals, buf)
+	sum, err = ses.Store(owner, ses.user, AsnRemovals, buf)
 	if err != nil {
 		ses.asn.Log("RM Store removal:", err)
 		return err
@@ -813,6 +1379,65 @@ func (ses *Ses) ExecRM(r io.Reader, args ...string) interface{} {
 	return sum
 }
 
+// unlistArgs stores the lists without the keys of the [~OWNER/]asn/LIST/KEY
+// arguments that aren't linked as these are listed by a whole OWNER/asn/LIST
+// blob; it returns the other arguments and the sum of the last stored list.
+func (ses *Ses) unlistArgs(args []string) (rest []string, sum *Sum,
+	err error) {
+	repos := ses.asn.repos
+	type unlisted struct {
+		owner *User
+		ln    string
+		keys  PubEncrList
+	}
+	var l []*unlisted
+	for _, arg := range args {
+		owner, name := ses.user, arg
+		slash := strings.Index(arg, "/")
+		if strings.HasPrefix(arg, "~") && slash > 0 {
+			owner, err = repos.users.Search(arg[1:slash])
+			if err != nil || owner == nil {
+				rest, err = append(rest, arg), nil
+				continue
+			}
+			name = arg[slash+1:]
+		}
+		ln, key := listKey(name)
+		if ln == "" || !owner.cache.PubEncrList(ln).Keys().Has(key) {
+			rest = append(rest, arg)
+			continue
+		}
+		fn := repos.Join(owner.Join(ln))
+		fi, xerr := repos.storage.Stat(fn)
+		if xerr != nil || fi.IsDir() {
+			rest = append(rest, arg)
+			continue
+		}
+		if !repos.MayRemove(owner, ses.user, name) {
+			return nil, nil, os.ErrPermission
+		}
+		var u *unlisted
+		for _, x := range l {
+			if x.owner == owner && x.ln == ln {
+				u = x
+			}
+		}
+		if u == nil {
+			keys := owner.cache.PubEncrList(ln).Keys()
+			u = &unlisted{owner, ln, keys}
+			l = append(l, u)
+		}
+		u.keys.KeyDel(key)
+	}
+	for _, u := range l {
+		if sum, err = ses.Store(u.owner, ses.user, u.ln,
+			&u.keys); err != nil {
+			return
+		}
+	}
+	return
+}
+
 func (ses *Ses) ExecTrace(args ...string) interface{} {
 	cmd := "flush"
 	if len(args) > 0 {
@@ -830,6 +1455,121 @@ func (ses *Ses) ExecTrace(args ...string) interface{} {
 	}
 }
 
+func (ses *Ses) ExecTxn(in io.Reader, args ...string) interface{} {
+	if len(args) < 1 || args[0] != "-" {
+		return &Usage{ExecTxnUsage}
+	}
+	repos := ses.asn.repos
+	f := repos.tmp.New()
+	defer repos.tmp.Free(f)
+	t := ses.asn.time.out
+	b := &bytes.Buffer{}
+	br := bufio.NewReader(in)
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		v := strings.Fields(line)
+		if len(v) != 2 {
+			return &Usage{ExecTxnUsage}
+		}
+		var size int64
+		if _, err = fmt.Sscan(v[1], &size); err != nil || size < 0 {
+			return &Usage{ExecTxnUsage}
+		}
+		owner, name, err := ses.blobOwner(v[0])
+		if err != nil {
+			return err
+		}
+		sum, err := WriteTxnBlob(f, owner, ses.user, name, t, br, size)
+		if err == io.EOF {
+			return &Error{v[0], "truncated"}
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintln(b, sum.FullString())
+	}
+	if b.Len() == 0 {
+		return &Usage{ExecTxnUsage}
+	}
+	f.Seek(0, os.SEEK_SET)
+	blob := NewBlobWith(&ses.user.key, &ses.user.key, AsnTransaction, t)
+	defer blob.Free()
+	if _, err := repos.Store(ses, Latest, blob, f); err != nil {
+		return err
+	}
+	return b
+}
+
+func (ses *Ses) ExecUnwatch(args ...string) interface{} {
+	if len(args) == 0 {
+		ses.asn.repos.Unwatch(ses, nil, "")
+		return nil
+	}
+	for _, arg := range args {
+		owner, glob, err := ses.watchArg(arg)
+		if err != nil {
+			return err
+		}
+		if err = ses.asn.repos.Unwatch(ses, owner, glob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ses *Ses) ExecUpload(in io.Reader, args ...string) interface{} {
+	var off int64
+	switch {
+	case len(args) == 2 && len(args[1]) == 2*SumSz && IsHex(args[1]):
+		up, err := ses.asn.repos.OpenUpload(ses.user, args[0])
+		if err != nil {
+			return err
+		}
+		sum, err := ses.asn.repos.CommitUpload(ses, up, args[1],
+			ses.asn.time.out)
+		if err != nil {
+			return err
+		}
+		return sum
+	case len(args) == 1 && IsUploadId(args[0]):
+		up, err := ses.asn.repos.OpenUpload(ses.user, args[0])
+		if err != nil {
+			return err
+		}
+		return up.String()
+	case len(args) == 2 && args[0] != "":
+		if _, err := fmt.Sscan(args[1], &off); err != nil {
+			return &Usage{ExecUploadUsage}
+		}
+		owner, name, err := ses.blobOwner(args[0])
+		if err != nil {
+			return err
+		}
+		up, err := ses.asn.repos.NewUpload(owner, ses.user, name, off)
+		if err != nil {
+			return err
+		}
+		return up.String()
+	case len(args) >= 3 && args[2] == "-":
+		if _, err := fmt.Sscan(args[1], &off); err != nil {
+			return &Usage{ExecUploadUsage}
+		}
+		up, err := ses.asn.repos.OpenUpload(ses.user, args[0])
+		if err != nil {
+			return err
+		}
+		if off, err = ses.asn.repos.WriteUpload(up, off, in); err != nil {
+			return err
+		}
+		return fmt.Sprintln(off)
+	}
+	return &Usage{ExecUploadUsage}
+}
+
 func (ses *Ses) ExecUsers(args ...string) interface{} {
 	if len(args) != 0 {
 		return &Usage{ExecUsersUsage}
@@ -861,6 +1601,52 @@ func (ses *Ses) ExecVouch(args ...string) interface{} {
 	return sum
 }
 
+func (ses *Ses) ExecWatch(args ...string) interface{} {
+	if len(args) == 0 {
+		b := &bytes.Buffer{}
+		ses.asn.repos.Watches(b, ses)
+		return b
+	}
+	for _, arg := range args {
+		owner, glob, err := ses.watchArg(arg)
+		if err != nil {
+			return err
+		}
+		if err = ses.asn.repos.Watch(ses, owner, glob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchArg returns the owner, nil for any, and name glob of a watch argument.
+func (ses *Ses) watchArg(arg string) (owner *User, glob string, err error) {
+	owner, glob = ses.user, arg
+	switch {
+	case arg == "":
+		err = &Usage{ExecWatchUsage}
+	case arg[0] == '/':
+		owner = ses.asn.repos.users.User(ses.cfg.Keys.Server.Pub.Encr)
+		glob = arg[1:]
+	case arg[0] == '~':
+		slash := strings.Index(arg, "/")
+		if slash < 0 {
+			err = &Usage{ExecWatchUsage}
+			return
+		}
+		glob = arg[slash+1:]
+		if arg[1:slash] == "*" {
+			owner = nil
+			return
+		}
+		owner, err = ses.asn.repos.users.Search(arg[1:slash])
+		if err == nil && owner == nil {
+			err = ErrNOENT
+		}
+	}
+	return
+}
+
 func (ses *Ses) ExecWho(req Req, args ...string) interface{} {
 	if len(args) != 0 {
 		return &Usage{ExecWhoUsage}
@@ -890,19 +1676,13 @@ func (ses *Ses) Blobber(filter func(fn string) error, r io.Reader,
 	filterIfNewer := func(fn string) error {
 		if this.IsZero() {
 			return filter(fn)
-		} else if fh, err := ReadFileHeader(fn); err != nil {
+		} else if t, err := repos.LinkTime(fn); err != nil {
 			return err
-		} else if fh.Blob.Time.After(this) {
+		} else if t.After(this) {
 			return filter(fn)
 		}
 		return nil
 	}
-	walker := func(fn string, info os.FileInfo, err error) error {
-		if err == nil && !info.IsDir() {
-			return filterIfNewer(fn)
-		}
-		return err
-	}
 	uf := func(u *User) (err error) {
 		var matches []string
 		defer func() {
@@ -917,12 +1697,12 @@ func (ses *Ses) Blobber(filter func(fn string) error, r io.Reader,
 		}
 		if umatch != "" {
 			uglob := repos.Join(u.Join(umatch))
-			matches, _ = filepath.Glob(uglob)
+			matches, _ = repos.storage.Glob(uglob)
 			if len(matches) == 0 {
 				return nil
 			}
 		}
-		matches, err = filepath.Glob(repos.Join(u.Join(glob)))
+		matches, err = repos.storage.Glob(repos.Join(u.Join(glob)))
 		if err != nil {
 			return
 		}
@@ -931,7 +1711,23 @@ func (ses *Ses) Blobber(filter func(fn string) error, r io.Reader,
 			return
 		}
 		for _, match := range matches {
-			if err = filepath.Walk(match, walker); err != nil {
+			if !this.IsZero() && !strings.ContainsAny(glob, "*?[") {
+				// NAME@TIME is the version current at TIME
+				fi, xerr := repos.storage.Stat(match)
+				if xerr == nil && !fi.IsDir() {
+					var fn string
+					fn, err = repos.VersionAt(match, this)
+					if err == nil && fn != "" {
+						err = filter(fn)
+					}
+					if err != nil {
+						return
+					}
+					continue
+				}
+			}
+			err = repos.storage.Walk(match, filterIfNewer)
+			if err != nil {
 				return
 			}
 		}
@@ -985,7 +1781,8 @@ func (ses *Ses) Blobber(filter func(fn string) error, r io.Reader,
 				if match == "" {
 					err = ErrNOENT
 				} else {
-					err = filepath.Walk(match, walker)
+					err = repos.storage.Walk(match,
+						filterIfNewer)
 				}
 			}
 		case arg == "~*":
@@ -1005,10 +1802,16 @@ func (ses *Ses) Blobber(filter func(fn string) error, r io.Reader,
 			err = repos.users.ForEachLoggedInUser(uf)
 		case arg[0] == '~' && slash < 0:
 			glob, mustExist = "*", true
-			err = uf(repos.users.UserString(arg[1:]))
+			var u *User
+			if u, err = repos.users.Search(arg[1:]); err == nil {
+				err = uf(u)
+			}
 		case arg[0] == '~' && slash > 0:
 			glob, mustExist = arg[slash+1:], true
-			err = uf(repos.users.UserString(arg[1:slash]))
+			var u *User
+			if u, err = repos.users.Search(arg[1:slash]); err == nil {
+				err = uf(u)
+			}
 		case staterr == nil && fi != nil:
 			err = filterIfNewer(arg)
 		default:
@@ -1019,6 +1822,21 @@ func (ses *Ses) Blobber(filter func(fn string) error, r io.Reader,
 	return
 }
 
+// open a repos blob or a local file named by a Blobber argument.
+func (ses *Ses) open(fn string) (*file.File, error) {
+	if strings.HasPrefix(fn, ses.asn.repos.dn) {
+		if strings.HasSuffix(fn, filepath.FromSlash(AsnMark)) {
+			user, _ := ses.asn.repos.ParsePath(fn)
+			if user != nil &&
+				!ses.asn.repos.MarkVisible(user, ses.user) {
+				return nil, os.ErrPermission
+			}
+		}
+		return ses.asn.repos.Open(fn)
+	}
+	return file.Open(fn)
+}
+
 func (ses *Ses) Store(owner, author *User, name string, wt WriteToer) (*Sum,
 	error) {
 	blob := NewBlobWith(&owner.key, &author.key, name, ses.asn.time.out)
@@ -1026,6 +1844,47 @@ func (ses *Ses) Store(owner, author *User, name string, wt WriteToer) (*Sum,
 	return ses.asn.repos.Store(ses, Latest, blob, wt)
 }
 
+// Range is a blob content OFFSET and, unless negative, LENGTH.
+type Range struct {
+	Off, Len int64
+}
+
+// Clip returns the offset and length of the range within the given size.
+func (rng *Range) Clip(size int64) (off, n int64) {
+	if rng.Off >= size {
+		return size, 0
+	}
+	off, n = rng.Off, size-rng.Off
+	if rng.Len >= 0 && rng.Len < n {
+		n = rng.Len
+	}
+	return
+}
+
+// StripRange removes a '#OFFSET[+LENGTH]' argument suffix.
+func StripRange(arg string) (rng *Range, argWoRange string) {
+	argWoRange = arg
+	hash := strings.LastIndex(arg, "#")
+	if hash < 0 {
+		return
+	}
+	t := &Range{Len: -1}
+	s := arg[hash+1:]
+	if plus := strings.Index(s, "+"); plus >= 0 {
+		n, err := strconv.ParseInt(s[plus+1:], 10, 64)
+		if err != nil || n < 0 {
+			return
+		}
+		t.Len, s = n, s[:plus]
+	}
+	off, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || off < 0 {
+		return
+	}
+	t.Off = off
+	return t, arg[:hash]
+}
+
 // StripTime removes '@TIME' argument suffixes
 func (ses *Ses) StripTime(arg string) (t time.Time, argWoTime string) {
 	argWoTime = arg
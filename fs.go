@@ -0,0 +1,234 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/apptimistco/asn/debug/file"
+)
+
+// FSStorage is the Repos backend of a file system directory of blob sum files
+// and the hard links that name them.
+type FSStorage struct {
+	dn string
+}
+
+func NewFSStorage(dn string) *FSStorage {
+	return &FSStorage{dn: dn}
+}
+
+func (fs *FSStorage) Filter(epoch time.Time,
+	f func(fn string) error) (err error) {
+	var (
+		topdir, subdir *os.File
+		topfis, subfis []os.FileInfo
+	)
+	topdir, err = os.Open(fs.dn)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err == io.EOF {
+			err = nil
+		}
+		topdir.Close()
+		subdir.Close()
+		topdir = nil
+		subdir = nil
+		topfis = nil
+		subfis = nil
+	}()
+topdirloop:
+	for {
+		topfis, err = topdir.Readdir(16)
+		if err != nil {
+			break topdirloop
+		}
+	topfiloop:
+		for _, topfi := range topfis {
+			if !IsTopDir(topfi) {
+				continue topfiloop
+			}
+			subfn := fs.join(topfi.Name())
+			if subdir, err = os.Open(subfn); err != nil {
+				return
+			}
+		subdirloop:
+			for {
+				subfis, err = subdir.Readdir(16)
+				if err == io.EOF {
+					break subdirloop
+				}
+				if err != nil {
+					return
+				}
+			subfiloop:
+				for _, subfi := range subfis {
+					if !IsBlob(subfi) {
+						continue subfiloop
+					}
+					fn := fs.join(topfi.Name(),
+						subfi.Name())
+					if epoch.IsZero() ||
+						BlobTime(fn).After(epoch) {
+						if err = f(fn); err != nil {
+							return
+						}
+					}
+				}
+			}
+			subdir.Close()
+		}
+	}
+	return
+}
+
+func (fs *FSStorage) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (fs *FSStorage) join(elements ...string) string {
+	return fs.dn + ReposPS + filepath.Join(elements...)
+}
+
+// Link will recover LN panics and return these as errors.
+func (fs *FSStorage) Link(src, dst string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	LN(src, dst)
+	return
+}
+
+func (fs *FSStorage) Mkdir(pn string) (err error) {
+	if _, err = os.Stat(pn); err != nil {
+		err = MkdirAll(pn)
+	}
+	return
+}
+
+func (fs *FSStorage) Nlink(pn string) (int, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(pn, &st); err != nil {
+		return 0, &os.PathError{Op: "stat", Path: pn, Err: err}
+	}
+	return int(st.Nlink), nil
+}
+
+func (fs *FSStorage) Open(pn string) (*file.File, error) {
+	return file.Open(pn)
+}
+
+func (fs *FSStorage) RemoveAll(pn string) error {
+	return os.RemoveAll(pn)
+}
+
+// Search the top directory of the given prefix for the unique longest
+// matching blob file.
+func (fs *FSStorage) Search(x string) (match string, err error) {
+	topdn := x[:ReposTopSz]
+	subdfn := x[ReposTopSz:]
+	lensubdfn := len(subdfn)
+	topf, err := file.Open(fs.join(topdn))
+	if err != nil {
+		return
+	}
+	defer topf.Close()
+	for {
+		var names []string
+		names, err = topf.Readdirnames(16)
+		if len(names) > 0 {
+			for _, name := range names {
+				if len(name) >= lensubdfn &&
+					name[:lensubdfn] == subdfn {
+					if match != "" {
+						match = ""
+						err = ErrAmbiguos
+						return
+					}
+					match = fs.join(topdn, name)
+				}
+			}
+		} else {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+	}
+}
+
+func (fs *FSStorage) Stat(pn string) (os.FileInfo, error) {
+	return os.Stat(pn)
+}
+
+// Store links the tmp file to the sum file unless it already exists.
+func (fs *FSStorage) Store(tmpfn, pn string) error {
+	if _, err := os.Stat(pn); err == nil {
+		return os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return fs.Link(tmpfn, pn)
+}
+
+func (fs *FSStorage) Unlink(pn string) error {
+	if err := syscall.Unlink(pn); err != nil {
+		return &os.PathError{Op: "unlink", Path: pn, Err: err}
+	}
+	return nil
+}
+
+func (fs *FSStorage) Users(f func(keystr string) error) error {
+	var (
+		topdir []os.FileInfo
+		subdir []os.FileInfo
+		err    error
+	)
+	defer func() {
+		topdir = nil
+		subdir = nil
+	}()
+	if topdir, err = ioutil.ReadDir(fs.dn); err != nil {
+		return &Error{fs.dn, err.Error()}
+	}
+	for _, fi := range topdir {
+		if fi.IsDir() && len(fi.Name()) == ReposTopSz {
+			subdn := fs.join(fi.Name())
+			if subdir, err = ioutil.ReadDir(subdn); err != nil {
+				return &Error{subdn, err.Error()}
+			}
+			for _, sub := range subdir {
+				if sub.IsDir() && IsUser(sub.Name()) {
+					err = f(fi.Name() + sub.Name())
+					if err != nil {
+						return err
+					}
+				}
+			}
+			subdir = nil
+		}
+	}
+	return nil
+}
+
+// Walk calls f with each file, but not directory, at or below pn.
+func (fs *FSStorage) Walk(pn string, f func(pn string) error) error {
+	return filepath.Walk(pn, func(fn string, info os.FileInfo,
+		err error) error {
+		if err == nil && !info.IsDir() {
+			return f(fn)
+		}
+		return err
+	})
+}
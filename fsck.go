@@ -0,0 +1,170 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Fsck problem categories
+const (
+	FsckSum     = "sum"     // sum file name isn't the SHA-512 of its content
+	FsckHeader  = "header"  // unreadable blob header
+	FsckOrphan  = "orphan"  // link without a sum file
+	FsckDerived = "derived" // message link with a bad DERIVED name
+	FsckAuth    = "auth"    // user without asn/auth
+)
+
+var FsckCategories = []string{
+	FsckSum,
+	FsckHeader,
+	FsckOrphan,
+	FsckDerived,
+	FsckAuth,
+}
+
+// Fsck checks the consistency of all sum files and user links, reporting
+// each problem to w as "CATEGORY: FILE: DETAIL" followed by a count of each
+// category of problem found. With repair, this renames misnamed sum files
+// and message links, relinks orphans to their sum file, and stores the cached
+// asn/auth of users that lack one, authored by the given user.
+func (repos *Repos) Fsck(x Sender, author *User, w io.Writer,
+	repair bool) error {
+	n := make(map[string]int)
+	if repair {
+		defer repos.InvalidateUsage()
+	}
+	report := func(cat, fn, detail string, repaired bool) {
+		n[cat] += 1
+		if repaired {
+			detail += " (repaired)"
+		}
+		fmt.Fprintf(w, "%s: %s: %s\n", cat, repos.DePrefix(fn), detail)
+	}
+	sumOf := func(fn string) (*Sum, error) {
+		f, err := repos.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return NewSumOf(f), nil
+	}
+	// rename fn to want unless already present
+	rename := func(fn, want string) bool {
+		if _, err := repos.storage.Stat(want); err != nil {
+			if err = repos.storage.Link(fn, want); err != nil {
+				repos.Diag(err)
+				return false
+			}
+		}
+		return repos.Unlink(fn) == nil
+	}
+	err := repos.Filter(Time0, func(fn string) error {
+		sum, err := sumOf(fn)
+		if err != nil {
+			report(FsckHeader, fn, err.Error(), false)
+			return nil
+		}
+		fh, err := repos.ReadFileHeader(fn)
+		if err != nil {
+			report(FsckHeader, fn, err.Error(), false)
+		}
+		if want := repos.Join(sum.PN()); want != fn {
+			repaired := repair && rename(fn, want)
+			if repaired && fh != nil {
+				repos.Index(sum, &fh.Blob, true, false)
+			}
+			report(FsckSum, fn, "should be "+repos.DePrefix(want),
+				repaired)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = repos.storage.Users(func(keystr string) error {
+		dn := repos.Join(userDN(keystr))
+		messages := filepath.Join(dn, filepath.FromSlash(AsnMessages))
+		authFN := filepath.Join(dn, filepath.FromSlash(AsnAuth))
+		if _, err := repos.storage.Stat(authFN); err != nil {
+			report(FsckAuth, authFN, "missing",
+				repair && repos.fsckAuth(x, author, keystr))
+		}
+		return repos.storage.Walk(dn, func(fn string) error {
+			if strings.HasSuffix(fn, filepath.FromSlash(AsnMark)) {
+				// marks don't retain a sum file
+				return nil
+			}
+			sum, err := sumOf(fn)
+			if err != nil {
+				report(FsckHeader, fn, err.Error(), false)
+				return nil
+			}
+			sumFN := repos.Join(sum.PN())
+			if _, err = repos.storage.Stat(sumFN); err != nil {
+				report(FsckOrphan, fn, "no "+sum.String(),
+					repair && repos.storage.Link(fn,
+						sumFN) == nil)
+			}
+			if filepath.Dir(fn) != messages {
+				return nil
+			}
+			fh, err := repos.ReadFileHeader(fn)
+			if err != nil {
+				report(FsckHeader, fn, err.Error(), false)
+				return nil
+			}
+			want := filepath.Join(messages, fh.Blob.FN(sum))
+			if want != fn {
+				report(FsckDerived, fn,
+					"should be "+filepath.Base(want),
+					repair && rename(fn, want))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, cat := range FsckCategories {
+		if n[cat] > 0 {
+			fmt.Fprintf(w, "%d %s\n", n[cat], cat)
+		}
+	}
+	return nil
+}
+
+// fsckAuth stores the cached or, for the admin and server, configured
+// authentication key of the given user.
+func (repos *Repos) fsckAuth(x Sender, author *User, keystr string) bool {
+	var empty PubAuth
+	user := repos.users.UserString(keystr)
+	if user == nil || author == nil {
+		return false
+	}
+	auth := user.cache.Auth()
+	if (auth == nil || *auth == empty) && repos.svc != nil {
+		for _, k := range []*UserKeys{
+			repos.svc.Admin,
+			repos.svc.Server,
+		} {
+			if bytes.Equal(user.key.Bytes(), k.Pub.Encr.Bytes()) {
+				auth = k.Pub.Auth
+			}
+		}
+	}
+	if auth == nil || *auth == empty {
+		return false
+	}
+	blob := NewBlobWith(&user.key, &author.key, AsnAuth, time.Now())
+	defer blob.Free()
+	_, err := repos.Store(x, Latest, blob, auth)
+	return err == nil
+}
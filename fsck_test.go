@@ -0,0 +1,66 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExecFsckPermission(t *testing.T) {
+	repos := newTestRepos(t, "fs")
+	defer freeTestRepos(repos)
+	user := newTestUser(t, repos)
+	ses := newTestSes(repos, user)
+	for _, args := range [][]string{nil, {"-r"}, {"--repair"}} {
+		if v := ses.ExecFsck(args...); v != os.ErrPermission {
+			t.Error("user fsck", args, v)
+		}
+	}
+	ses = newTestSes(repos, testAdmin(repos))
+	if _, ok := ses.ExecFsck("-x").(*Usage); !ok {
+		t.Error("fsck -x isn't usage")
+	}
+	if _, ok := ses.ExecFsck().(*bytes.Buffer); !ok {
+		t.Error("admin fsck failed")
+	}
+}
+
+func TestFsckOrphan(t *testing.T) {
+	repos := newTestRepos(t, "fs")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	admin := testAdmin(repos)
+	owner := newTestUser(t, repos)
+	sum, err := testStore(repos, x, owner, owner, "a", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sumFN := repos.Join(sum.PN())
+	repos.storage.Unlink(sumFN)
+	b := new(bytes.Buffer)
+	if err = repos.Fsck(x, admin, b, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), FsckOrphan+": "+
+		repos.DePrefix(repos.Join(owner.Join("a")))) {
+		t.Error("orphan not found:\n", b)
+	}
+	if _, err = repos.storage.Stat(sumFN); err == nil {
+		t.Error("repaired without --repair")
+	}
+	b.Reset()
+	if err = repos.Fsck(x, admin, b, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "(repaired)") {
+		t.Error("orphan not repaired:\n", b)
+	}
+	if _, err = repos.storage.Stat(sumFN); err != nil {
+		t.Error(err)
+	}
+}
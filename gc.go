@@ -0,0 +1,132 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apptimistco/asn/debug/mutex"
+)
+
+const (
+	GCBatch      = 100
+	GCBatchPause = 100 * time.Millisecond
+	GCGrace      = time.Hour
+)
+
+// GCConfig schedules server garbage collection. Interval and Grace are ages
+// (e.g. "24h" or "7d"); Grace, GCGrace by default, protects unlinked blobs
+// that were stored more recently, such as those of stores in progress. Each
+// pass pauses after every Batch of removals so that it doesn't hold up
+// stores.
+type GCConfig struct {
+	Interval string `yaml:"interval,omitempty"`
+	Grace    string `yaml:"grace,omitempty"`
+	Batch    int    `yaml:"batch,omitempty"`
+}
+
+// GCStats summarizes a garbage collection pass.
+type GCStats struct {
+	Blobs int
+	Bytes int64
+}
+
+func (stats GCStats) String() string {
+	return fmt.Sprintf("%d blobs, %d bytes", stats.Blobs, stats.Bytes)
+}
+
+// reposInflight counts the stores in progress of each sum file as these
+// aren't linked until dispatched.
+type reposInflight struct {
+	mutex.Mutex
+	m map[string]int
+}
+
+// storing marks the start, or with done, the end of a sum file's store.
+func (repos *Repos) storing(sumFN string, done bool) {
+	repos.inflight.Lock()
+	defer repos.inflight.Unlock()
+	if repos.inflight.m == nil {
+		repos.inflight.m = make(map[string]int)
+	}
+	if !done {
+		repos.inflight.m[sumFN] += 1
+	} else if repos.inflight.m[sumFN] -= 1; repos.inflight.m[sumFN] <= 0 {
+		delete(repos.inflight.m, sumFN)
+	}
+}
+
+// isStoring returns true if there's a store in progress of the sum file.
+func (repos *Repos) isStoring(sumFN string) bool {
+	repos.inflight.Lock()
+	defer repos.inflight.Unlock()
+	return repos.inflight.m[sumFN] > 0
+}
+
+// GC removes the sum files that are no longer linked by any user, aren't
+// being stored or within the grace period and, if before isn't zero, have a
+// blob time before then. Removed, or with dryrun, would be removed, files
+// are listed to w if not nil.
+func (repos *Repos) GC(w io.Writer, before time.Time,
+	dryrun bool) (stats GCStats, err error) {
+	grace := GCGrace
+	batch := GCBatch
+	if repos.gc != nil {
+		if repos.gc.Grace != "" {
+			if grace, err = ParseAge(repos.gc.Grace); err != nil {
+				return
+			}
+		}
+		if repos.gc.Batch > 0 {
+			batch = repos.gc.Batch
+		}
+	}
+	stored := time.Now().Add(-grace)
+	err = repos.Filter(Time0, func(fn string) error {
+		if strings.HasSuffix(fn, filepath.FromSlash(AsnMark)) {
+			return nil
+		}
+		nlink, err := repos.storage.Nlink(fn)
+		if err != nil || nlink != 1 || repos.isStoring(fn) {
+			return err
+		}
+		fi, err := repos.storage.Stat(fn)
+		if err != nil {
+			return err
+		}
+		if grace > 0 && fi.ModTime().After(stored) {
+			return nil
+		}
+		if !before.IsZero() {
+			if t, err := repos.LinkTime(fn); err != nil ||
+				!t.Before(before) {
+				return nil
+			}
+		}
+		if dryrun {
+			if w != nil {
+				fmt.Fprintf(w, "would remove `%s'\n", fn)
+			}
+		} else {
+			if err = repos.Unlink(fn); err != nil {
+				return err
+			}
+			if w != nil {
+				fmt.Fprintf(w, "removed `%s'\n", fn)
+			}
+		}
+		stats.Blobs += 1
+		stats.Bytes += fi.Size()
+		if stats.Blobs%batch == 0 {
+			time.Sleep(GCBatchPause)
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,118 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// testUnlinked stores a blob then removes its links, leaving only its sum
+// file stored at the given time.
+func testUnlinked(t *testing.T, repos *Repos, owner *User, name string,
+	stored time.Time) string {
+	x := new(testSender)
+	sum, err := testStore(repos, x, owner, owner, name, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sumFN := repos.Join(sum.PN())
+	repos.Unlink(repos.Join(owner.Join(name)))
+	repos.storage.RemoveAll(repos.Join(owner.Join(AsnHistory)))
+	if n, err := repos.storage.Nlink(sumFN); err != nil || n != 1 {
+		t.Fatal("nlink", n, err)
+	}
+	if err = os.Chtimes(sumFN, stored, stored); err != nil {
+		t.Fatal(err)
+	}
+	return sumFN
+}
+
+func TestGCGrace(t *testing.T) {
+	repos := newTestRepos(t, "fs")
+	defer freeTestRepos(repos)
+	owner := newTestUser(t, repos)
+	now := time.Now()
+	recent := testUnlinked(t, repos, owner, "recent", now)
+	old := testUnlinked(t, repos, owner, "old", now.Add(-2*GCGrace))
+	stats, err := repos.GC(nil, Time0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blobs != 1 {
+		t.Error("collected", stats)
+	}
+	if _, err = repos.storage.Stat(recent); err != nil {
+		t.Error("collected blob within default grace")
+	}
+	if _, err = repos.storage.Stat(old); err == nil {
+		t.Error("didn't collect blob beyond default grace")
+	}
+	repos.Set(&GCConfig{Grace: "0"})
+	if stats, err = repos.GC(nil, Time0, false); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blobs != 1 {
+		t.Error("collected", stats, "without grace")
+	}
+}
+
+func TestGCStoring(t *testing.T) {
+	repos := newTestRepos(t, "fs")
+	defer freeTestRepos(repos)
+	repos.Set(&GCConfig{Grace: "0"})
+	owner := newTestUser(t, repos)
+	sumFN := testUnlinked(t, repos, owner, "a", time.Now())
+	repos.storing(sumFN, false)
+	if stats, _ := repos.GC(nil, Time0, false); stats.Blobs != 0 {
+		t.Error("collected blob being stored")
+	}
+	repos.storing(sumFN, true)
+	if repos.isStoring(sumFN) {
+		t.Error("still storing")
+	}
+	if stats, _ := repos.GC(nil, Time0, true); stats.Blobs != 1 {
+		t.Error("dry run", stats)
+	}
+	if _, err := repos.storage.Stat(sumFN); err != nil {
+		t.Error("dry run collected", sumFN)
+	}
+}
+
+func TestExecGC(t *testing.T) {
+	repos := newTestRepos(t, "fs")
+	defer freeTestRepos(repos)
+	repos.Set(&GCConfig{Grace: "0"})
+	owner := newTestUser(t, repos)
+	sumFN := testUnlinked(t, repos, owner, "a", time.Now())
+	ses := newTestSes(repos, testAdmin(repos))
+	var req Req
+	for _, args := range [][]string{
+		{"@-1h"},
+		{"--before"},
+		{"bogus"},
+	} {
+		if _, ok := ses.ExecGC(req, args...).(*Usage); !ok {
+			t.Error("gc", args)
+		}
+	}
+	if _, ok := ses.ExecGC(req, "-b", "bogus").(*Error); !ok {
+		t.Error("gc before invalid time")
+	}
+	// the blob isn't older than an hour ago
+	if v := ses.ExecGC(req, "--before", "-1h"); v != "0 blobs, 0 bytes\n" {
+		t.Error("gc before an hour ago", v)
+	}
+	if _, err := repos.storage.Stat(sumFN); err != nil {
+		t.Fatal("collected newer blob")
+	}
+	if _, ok := ses.ExecGC(req, "-b", "+1h").(string); !ok {
+		t.Error("gc before an hour from now")
+	}
+	if _, err := repos.storage.Stat(sumFN); err == nil {
+		t.Error("didn't collect older blob")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// HistoryConfig limits the versions of each named blob that are kept as
+// USER/asn/history/NAME/DERIVED links. Those beyond the latest Keep or older
+// than Age, except the current, are removed as new versions are stored. Both
+// are unlimited if zero or empty; without a configuration, HistoryDefault
+// applies.
+type HistoryConfig struct {
+	Keep int    `yaml:"keep,omitempty"`
+	Age  string `yaml:"age,omitempty"`
+}
+
+// HistoryDefault limits the history of servers that aren't configured.
+var HistoryDefault = HistoryConfig{Keep: 10}
+
+// versions returns the history links of the named blob, latest first.
+func (repos *Repos) versions(owner *User, name string) (l retainees,
+	err error) {
+	dn := repos.Join(owner.Join(AsnHistory, name))
+	err = repos.storage.Walk(dn, func(fn string) error {
+		if t, ok := derivedTime(fn); ok {
+			l = append(l, retainee{fn, t})
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	sort.Sort(l)
+	return
+}
+
+// historyLN links another version of the named blob into its history then
+// removes those beyond the configured limits.
+func (repos *Repos) historyLN(sumFN string, owner *User, blob *Blob,
+	sum *Sum) {
+	repos.LN(sumFN, repos.Join(owner.Join(AsnHistory, blob.Name,
+		blob.FN(sum))))
+	history := repos.history
+	if history == nil {
+		history = &HistoryDefault
+	}
+	if history.Keep <= 0 && history.Age == "" {
+		return
+	}
+	var cutoff time.Time
+	if history.Age != "" {
+		age, err := ParseAge(history.Age)
+		if err != nil {
+			repos.Diag(err)
+			return
+		}
+		cutoff = time.Now().Add(-age)
+	}
+	l, err := repos.versions(owner, blob.Name)
+	if err != nil {
+		repos.Diag(err)
+		return
+	}
+	for i, r := range l {
+		if i == 0 {
+			continue // current
+		}
+		if (history.Keep > 0 && i >= history.Keep) ||
+			(!cutoff.IsZero() && r.t.Before(cutoff)) {
+			repos.Unlink(r.fn)
+		}
+	}
+}
+
+// History writes the time and sum of each recorded version of the named
+// blob to w, latest first.
+func (repos *Repos) History(w io.Writer, owner *User, name string) error {
+	l, err := repos.versions(owner, name)
+	if err != nil {
+		return err
+	}
+	if len(l) == 0 {
+		return ErrNOENT
+	}
+	for _, r := range l {
+		base := filepath.Base(r.fn)
+		fmt.Fprintln(w, r.t.UnixNano(), "$"+base[len(base)-16:],
+			r.t.Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+// VersionAt returns the named link, if not newer than the given time, or
+// the latest history link that isn't; an empty string if there isn't one.
+func (repos *Repos) VersionAt(fn string, at time.Time) (string, error) {
+	if t, err := repos.LinkTime(fn); err != nil {
+		return "", err
+	} else if !t.After(at) {
+		return fn, nil
+	}
+	owner, name := repos.ParsePath(fn)
+	if owner == nil {
+		return "", nil
+	}
+	l, err := repos.versions(owner, filepath.ToSlash(name))
+	if err != nil {
+		return "", err
+	}
+	for _, r := range l {
+		if !r.t.After(at) {
+			return r.fn, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testVersions stores n versions of the named blob and returns the number of
+// those in its history.
+func testVersions(t *testing.T, repos *Repos, n int) int {
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		_, err := testStoreAt(repos, x, owner, owner, "a", fmt.Sprint(i),
+			now.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := repos.versions(owner, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(l)
+}
+
+func TestHistoryDefault(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	if n := testVersions(t, repos, HistoryDefault.Keep+2); n !=
+		HistoryDefault.Keep {
+		t.Error("kept", n, "of", HistoryDefault.Keep)
+	}
+}
+
+func TestHistoryConfig(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	repos.Set(&HistoryConfig{Keep: 2})
+	if n := testVersions(t, repos, 4); n != 2 {
+		t.Error("kept", n, "of 2")
+	}
+	// explicitly unlimited
+	repos.Set(&HistoryConfig{})
+	if n := testVersions(t, repos, HistoryDefault.Keep+2); n !=
+		HistoryDefault.Keep+2 {
+		t.Error("unlimited kept", n)
+	}
+	repos.Set(&HistoryConfig{Age: "bogus"})
+	if n := testVersions(t, repos, 2); n != 2 {
+		t.Error("invalid age kept", n)
+	}
+	owner := newTestUser(t, repos)
+	if err := repos.History(new(bytes.Buffer), owner, "a"); err != ErrNOENT {
+		t.Error("history of nosuch", err)
+	}
+}
@@ -0,0 +1,508 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apptimistco/asn/debug/mutex"
+)
+
+const (
+	// ReposIndexFN is the journal of the blob index within the repos
+	// directory.
+	ReposIndexFN = "index"
+	// IndexCompactMin is the number of journal records before the index
+	// is rewritten once most of these are superseded.
+	IndexCompactMin = 4096
+)
+
+// indexEntry is the blob time, owner and name of a sum file.
+type indexEntry struct {
+	t     time.Time
+	sum   string // full string
+	owner string // full string
+	name  string
+	gone  bool
+}
+
+type indexEntries []*indexEntry
+
+func (l indexEntries) Len() int           { return len(l) }
+func (l indexEntries) Less(i, j int) bool { return l[i].t.Before(l[j].t) }
+func (l indexEntries) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// reposIndex orders the repos sum files by blob time and records the time of
+// each named link so that time bounded queries don't have to read every blob
+// header. Changes are appended to the ReposIndexFN journal as:
+//
+//   + TIME SUM OWNER NAME
+//   > TIME FILE
+//   - FILE
+//
+// where TIME is hexadecimal UnixNano and FILE is relative to the repos
+// directory. The first is a sum file and the second the blob time of the
+// version currently linked as FILE. Additions are synced; lost removals are
+// reconciled with the storage on load. MemStorage indexes aren't journaled.
+type reposIndex struct {
+	mutex.Mutex
+	entries indexEntries // sorted by time unless dirty
+	dirty   bool
+	sums    map[string]*indexEntry // by relative sum file name
+	links   map[string]time.Time   // by relative link name
+	fn      string
+	w       *os.File
+	records int // of the journal
+	// sorted sum strings by their first byte for prefix search
+	prefix [256][]string
+}
+
+// indexLinked returns true if a blob of the given name is linked to the
+// same name in its owner's directory.
+func indexLinked(name string) bool {
+	switch {
+	case name == "", name == AsnMessages, name == AsnBridge,
+		name == AsnApprovals, name == AsnRejections,
+		name == AsnRemovals, name == AsnTransaction,
+		strings.HasSuffix(name, "/"):
+		return false
+	}
+	return true
+}
+
+// derivedTime returns the time encoded in a DERIVED message file name.
+func derivedTime(fn string) (t time.Time, ok bool) {
+	base := filepath.Base(fn)
+	if len(base) != 16+1+16 || base[16] != '_' || !IsHex(base[17:]) {
+		return
+	}
+	ns, err := strconv.ParseUint(base[:16], 16, 64)
+	if err != nil {
+		return
+	}
+	return time.Unix(0, int64(ns)), true
+}
+
+func (index *reposIndex) reset() {
+	index.entries = nil
+	index.dirty = false
+	index.sums = make(map[string]*indexEntry)
+	index.links = make(map[string]time.Time)
+	for i := range index.prefix {
+		index.prefix[i] = nil
+	}
+	if index.w != nil {
+		index.w.Close()
+		index.w = nil
+	}
+	index.fn = ""
+	index.records = 0
+}
+
+// add indexes the sum file of an entry; the caller must hold the lock.
+func (index *reposIndex) add(e *indexEntry) {
+	pn := userDN(e.sum)
+	if _, ok := index.sums[pn]; !ok {
+		index.sums[pn] = e
+		index.entries = append(index.entries, e)
+		index.dirty = true
+		index.insertPrefix(e.sum)
+	}
+}
+
+// remove forgets the named sum file or link; the caller must hold the lock.
+func (index *reposIndex) remove(pn string) {
+	if e, ok := index.sums[pn]; ok {
+		e.gone = true
+		delete(index.sums, pn)
+		index.dirty = true
+		index.removePrefix(e.sum)
+	}
+	delete(index.links, pn)
+}
+
+// bucket returns the prefix bucket of the given sum string or abbreviation.
+func (index *reposIndex) bucket(s string) (*[]string, bool) {
+	if len(s) < ReposTopSz {
+		return nil, false
+	}
+	b, err := strconv.ParseUint(s[:ReposTopSz], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+	return &index.prefix[b], true
+}
+
+func (index *reposIndex) insertPrefix(s string) {
+	l, ok := index.bucket(s)
+	if !ok {
+		return
+	}
+	i := sort.SearchStrings(*l, s)
+	if i < len(*l) && (*l)[i] == s {
+		return
+	}
+	*l = append(*l, "")
+	copy((*l)[i+1:], (*l)[i:])
+	(*l)[i] = s
+}
+
+func (index *reposIndex) removePrefix(s string) {
+	l, ok := index.bucket(s)
+	if !ok {
+		return
+	}
+	i := sort.SearchStrings(*l, s)
+	if i < len(*l) && (*l)[i] == s {
+		*l = append((*l)[:i], (*l)[i+1:]...)
+	}
+}
+
+// search returns the unique sum string with the given prefix, an empty
+// string if there isn't one, or ErrAmbiguos; the caller must hold the lock.
+func (index *reposIndex) search(x string) (string, error) {
+	l, ok := index.bucket(x)
+	if !ok {
+		return "", nil
+	}
+	i := sort.SearchStrings(*l, x)
+	if i == len(*l) || !strings.HasPrefix((*l)[i], x) {
+		return "", nil
+	}
+	if i+1 < len(*l) && strings.HasPrefix((*l)[i+1], x) {
+		return "", ErrAmbiguos
+	}
+	return (*l)[i], nil
+}
+
+// sort drops removed entries and orders the rest by time; the caller must
+// hold the lock.
+func (index *reposIndex) sort() {
+	if !index.dirty {
+		return
+	}
+	entries := index.entries[:0]
+	for _, e := range index.entries {
+		if !e.gone {
+			entries = append(entries, e)
+		}
+	}
+	index.entries = entries
+	sort.Stable(index.entries)
+	index.dirty = false
+}
+
+// journal appends a record then, if most are superseded, rewrites the
+// journal; the caller must hold the lock.
+func (index *reposIndex) journal(format string, args ...interface{}) {
+	if index.w == nil {
+		return
+	}
+	fmt.Fprintf(index.w, format, args...)
+	index.records += 1
+	if index.records > IndexCompactMin &&
+		index.records > 2*(len(index.sums)+len(index.links)) {
+		if err := index.compact(); err != nil {
+			index.Diag("compact", err)
+		}
+	}
+}
+
+// compact rewrites the journal with the current entries and links; the
+// caller must hold the lock.
+func (index *reposIndex) compact() error {
+	if index.w != nil {
+		index.w.Close()
+		index.w = nil
+	}
+	err := index.write(index.fn)
+	if err != nil {
+		return err
+	}
+	index.w, err = os.OpenFile(index.fn, os.O_WRONLY|os.O_APPEND, 0660)
+	return err
+}
+
+// write creates a journal of the current entries and links; the caller must
+// hold the lock.
+func (index *reposIndex) write(fn string) error {
+	tmpfn := fn + ".tmp"
+	w, err := os.Create(tmpfn)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	index.sort()
+	for _, e := range index.entries {
+		fmt.Fprintf(bw, "+ %016x %s %s %s\n", e.t.UnixNano(), e.sum,
+			e.owner, e.name)
+	}
+	for pn, t := range index.links {
+		fmt.Fprintf(bw, "> %016x %s\n", t.UnixNano(), pn)
+	}
+	index.records = len(index.entries) + len(index.links)
+	if err = bw.Flush(); err == nil {
+		err = w.Sync()
+	}
+	w.Close()
+	if err == nil {
+		err = os.Rename(tmpfn, fn)
+	}
+	if err != nil {
+		os.Remove(tmpfn)
+	}
+	return err
+}
+
+// LoadIndex replays the index journal or, if there isn't one, rebuilds it
+// from the header of every sum file. The replayed index is reconciled with
+// the stored sum files and links in case removals were lost.
+func (repos *Repos) LoadIndex() error {
+	index := &repos.index
+	index.Lock()
+	defer index.Unlock()
+	index.reset()
+	index.Mutex.Set(repos.dn + "{index}")
+	if _, ok := repos.storage.(*MemStorage); ok {
+		return repos.rebuildIndex()
+	}
+	index.fn = repos.Join(ReposIndexFN)
+	if f, err := os.Open(index.fn); err == nil {
+		err = repos.replayIndex(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if err = repos.reconcileIndex(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if err = repos.rebuildIndex(); err != nil {
+		return err
+	}
+	return index.compact()
+}
+
+// rebuildIndex scans the sum files; the caller must hold the lock. Link
+// times are found from the header of each link as these are looked up.
+func (repos *Repos) rebuildIndex() error {
+	return repos.storage.Filter(Time0, func(fn string) error {
+		repos.indexFile(fn)
+		return nil
+	})
+}
+
+// indexFile adds the named sum file from its header; the caller must hold
+// the lock.
+func (repos *Repos) indexFile(fn string) *indexEntry {
+	fh, err := repos.ReadFileHeader(fn)
+	if err != nil {
+		repos.Diag(err)
+		return nil
+	}
+	e := &indexEntry{
+		t:     fh.Blob.Time,
+		sum:   repos.sumString(fn),
+		owner: fh.Blob.Owner.FullString(),
+		name:  fh.Blob.Name,
+	}
+	repos.index.add(e)
+	return e
+}
+
+// reconcileIndex adds the sum files that are missing from the replayed
+// index and forgets those sum files and links that are gone; the caller must
+// hold the lock.
+func (repos *Repos) reconcileIndex() error {
+	index := &repos.index
+	stored := make(map[string]struct{})
+	err := repos.storage.Filter(Time0, func(fn string) error {
+		pn := repos.DePrefix(fn)
+		stored[pn] = struct{}{}
+		if _, ok := index.sums[pn]; !ok {
+			repos.Diag("indexing", pn)
+			repos.indexFile(fn)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for pn := range index.sums {
+		if _, ok := stored[pn]; !ok {
+			repos.Diag("unindexing", pn)
+			index.remove(pn)
+		}
+	}
+	for pn := range index.links {
+		if _, err = repos.storage.Stat(repos.Join(pn)); err != nil {
+			delete(index.links, pn)
+		}
+	}
+	return nil
+}
+
+// replayIndex reads the journal; the caller must hold the lock.
+func (repos *Repos) replayIndex(f *os.File) error {
+	index := &repos.index
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		index.records += 1
+		if strings.HasPrefix(line, "- ") {
+			index.remove(line[2:])
+			continue
+		}
+		v := strings.SplitN(line, " ", 5)
+		if len(v) < 3 || (v[0] != "+" && v[0] != ">") ||
+			(v[0] == "+" && len(v) != 5) {
+			repos.Diag("bad index entry:", line)
+			continue
+		}
+		ns, err := strconv.ParseUint(v[1], 16, 64)
+		if err != nil {
+			repos.Diag("bad index time:", line)
+			continue
+		}
+		t := time.Unix(0, int64(ns))
+		if v[0] == ">" {
+			index.links[strings.Join(v[2:], " ")] = t
+			continue
+		}
+		index.add(&indexEntry{
+			t:     t,
+			sum:   v[2],
+			owner: v[3],
+			name:  v[4],
+		})
+	}
+	return scanner.Err()
+}
+
+// Index records a stored blob. Its sum file is indexed if retained and its
+// time recorded for the owner's link of the same name if that's now the
+// linked version.
+func (repos *Repos) Index(sum *Sum, blob *Blob, retained, linked bool) {
+	if !retained && !linked {
+		return
+	}
+	e := &indexEntry{
+		t:     blob.Time,
+		sum:   sum.FullString(),
+		owner: blob.Owner.FullString(),
+		name:  blob.Name,
+	}
+	index := &repos.index
+	index.Lock()
+	defer index.Unlock()
+	if retained {
+		index.add(e)
+		index.journal("+ %016x %s %s %s\n", e.t.UnixNano(), e.sum,
+			e.owner, e.name)
+	}
+	if linked && indexLinked(e.name) {
+		pn := filepath.Join(userDN(e.owner), filepath.FromSlash(e.name))
+		index.links[pn] = e.t
+		index.journal("> %016x %s\n", e.t.UnixNano(), pn)
+	}
+	if index.w != nil {
+		index.w.Sync()
+	}
+}
+
+// IndexFilter calls f with each indexed sum file that has a blob time after
+// epoch in time order.
+func (repos *Repos) IndexFilter(epoch time.Time,
+	f func(fn string) error) error {
+	var fns []string
+	index := &repos.index
+	index.Lock()
+	index.sort()
+	i := sort.Search(len(index.entries), func(i int) bool {
+		return index.entries[i].t.After(epoch)
+	})
+	for _, e := range index.entries[i:] {
+		fns = append(fns, repos.Join(userDN(e.sum)))
+	}
+	index.Unlock()
+	for _, fn := range fns {
+		if _, err := repos.storage.Stat(fn); err != nil {
+			continue
+		}
+		if err := f(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LinkTime returns the blob time of the named sum file or link from its
+// DERIVED name or the index before resorting to its header.
+func (repos *Repos) LinkTime(fn string) (time.Time, error) {
+	if t, ok := derivedTime(fn); ok {
+		return t, nil
+	}
+	pn := repos.DePrefix(fn)
+	repos.index.Lock()
+	if e, ok := repos.index.sums[pn]; ok {
+		repos.index.Unlock()
+		return e.t, nil
+	}
+	t, ok := repos.index.links[pn]
+	repos.index.Unlock()
+	if ok {
+		return t, nil
+	}
+	t, err := repos.BlobTime(fn)
+	if user, name := repos.ParsePath(fn); err == nil && user != nil &&
+		indexLinked(filepath.ToSlash(name)) {
+		// these aren't journaled as they're found again from the link
+		repos.index.Lock()
+		repos.index.links[pn] = t
+		repos.index.Unlock()
+	}
+	return t, err
+}
+
+// SearchIndex returns the sum file name of the unique indexed sum that
+// begins with x.
+func (repos *Repos) SearchIndex(x string) (string, error) {
+	repos.index.Lock()
+	s, err := repos.index.search(strings.ToLower(x))
+	repos.index.Unlock()
+	if s == "" || err != nil {
+		return "", err
+	}
+	return repos.Expand(s), nil
+}
+
+// Unindex forgets the given removed sum file or link.
+func (repos *Repos) Unindex(fn string) {
+	pn := repos.DePrefix(fn)
+	repos.index.Lock()
+	defer repos.index.Unlock()
+	repos.index.remove(pn)
+	repos.index.journal("- %s\n", pn)
+}
+
+// unindexLink forgets the time of the named link, if indexed, as it's being
+// replaced.
+func (repos *Repos) unindexLink(fn string) {
+	pn := repos.DePrefix(fn)
+	repos.index.Lock()
+	defer repos.index.Unlock()
+	if _, ok := repos.index.links[pn]; ok {
+		delete(repos.index.links, pn)
+		repos.index.journal("- %s\n", pn)
+	}
+}
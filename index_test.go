@@ -0,0 +1,121 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIndexLinked(t *testing.T) {
+	repos := newTestRepos(t, "fs")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	author := newTestUser(t, repos)
+	moderator := newTestUser(t, repos)
+	t1 := time.Now()
+	t0 := t1.Add(-time.Hour)
+	t2 := t1.Add(time.Hour)
+	fn := repos.Join(owner.Join("a"))
+	check := func(desc string) {
+		if lt, err := repos.LinkTime(fn); err != nil || !lt.Equal(t1) {
+			t.Error(desc, "link time", lt, err)
+		}
+	}
+	if _, err := testStoreAt(repos, x, owner, owner, "a", "1", t1); err != nil {
+		t.Fatal(err)
+	}
+	// superseded
+	if _, err := testStoreAt(repos, x, owner, owner, "a", "0", t0); err != nil {
+		t.Fatal(err)
+	}
+	check("superseded")
+	// staged
+	_, err := testStore(repos, x, owner, owner,
+		AsnModerators+"/"+moderator.FullString(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = testStoreAt(repos, x, owner, author, "a", "2", t2); err != nil {
+		t.Fatal(err)
+	}
+	check("staged")
+	if err = repos.LoadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	check("replayed")
+	os.Remove(repos.Join(ReposIndexFN))
+	if err = repos.LoadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	check("rebuilt")
+}
+
+func TestIndexReconcile(t *testing.T) {
+	repos := newTestRepos(t, "fs")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	gone, err := testStore(repos, x, owner, owner, "gone", "gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lose the removal of one and the addition of another
+	repos.storage.Unlink(repos.Join(gone.PN()))
+	repos.index.Lock()
+	w := repos.index.w
+	repos.index.w = nil
+	repos.index.Unlock()
+	lost, err := testStore(repos, x, owner, owner, "lost", "lost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err = repos.LoadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if fn, _ := repos.SearchIndex(gone.FullString()); fn != "" {
+		t.Error("indexed removed sum", fn)
+	}
+	if fn, _ := repos.SearchIndex(lost.FullString()); fn !=
+		repos.Join(lost.PN()) {
+		t.Error("missing sum", fn)
+	}
+}
+
+func TestIndexCompact(t *testing.T) {
+	repos := newTestRepos(t, "fs")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	sum, err := testStore(repos, x, owner, owner, "a", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := repos.Join(owner.Join("b"))
+	for i := 0; i <= IndexCompactMin; i++ {
+		repos.Unindex(fn)
+	}
+	b, err := ioutil.ReadFile(repos.Join(ReposIndexFN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("\n")); n > 16 {
+		t.Error("index journal wasn't compacted:", n, "records")
+	}
+	if fn, _ := repos.SearchIndex(sum.FullString()); fn == "" {
+		t.Error("compaction lost", sum)
+	}
+	if err = repos.LoadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if fn, _ := repos.SearchIndex(sum.FullString()); fn == "" {
+		t.Error("compacted journal lost", sum)
+	}
+}
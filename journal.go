@@ -0,0 +1,311 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apptimistco/asn/debug/mutex"
+)
+
+// ReposJournalFN is the store journal within the repos directory.
+const ReposJournalFN = "journal"
+
+// Journal events
+const (
+	JournalStore      = "store"      // SUM file to be stored
+	JournalLink       = "link"       // SRC linked to DST
+	JournalUnlink     = "unlink"     // FILE removed
+	JournalDone       = "done"       // SUM store completed
+	JournalCheckpoint = "checkpoint" // CURSOR of the discarded events
+)
+
+// JournalMax is the size of the journal beyond which it is truncated at the
+// next checkpoint.
+var JournalMax int64 = 16 << 20
+
+// reposJournal is an append-only record of repos changes with lines of:
+//
+//	TIME EVENT ARGS...
+//
+// where TIME is hexadecimal UnixNano and file arguments are relative to the
+// repos directory. A store event is synced before its sum file is stored so
+// that Recover may finish the stores without a done event after a crash. The
+// stores of a transaction's blobs aren't journaled as Recover redispatches the
+// whole transaction instead. The byte offset following an event is its
+// cursor in the change feed.
+//
+// Once the journal is beyond JournalMax and there are no unfinished stores,
+// it's truncated to a checkpoint event with the cursor that it replaces so
+// that cursors continue from there. MemStorage journals are kept in memory.
+type reposJournal struct {
+	mutex.Mutex
+	f       *os.File
+	buf     *bytes.Buffer
+	base    int64 // cursor of the first event
+	off     int64 // cursor of the end
+	pending int   // stores without done events
+}
+
+func (journal *reposJournal) reset() {
+	if journal.f != nil {
+		journal.f.Close()
+		journal.f = nil
+	}
+	journal.buf = nil
+	journal.base = 0
+	journal.off = 0
+	journal.pending = 0
+}
+
+// append an event; store events are synced.
+func (journal *reposJournal) append(event string, args ...string) {
+	journal.Lock()
+	defer journal.Unlock()
+	line := fmt.Sprintf("%016x %s %s\n", time.Now().UnixNano(), event,
+		strings.Join(args, " "))
+	if err := journal.write(line, event == JournalStore); err != nil {
+		journal.Diag(err)
+		return
+	}
+	switch event {
+	case JournalStore:
+		journal.pending += 1
+	case JournalDone:
+		if journal.pending > 0 {
+			journal.pending -= 1
+		}
+		if journal.pending == 0 &&
+			journal.off-journal.base > JournalMax {
+			if err := journal.checkpoint(); err != nil {
+				journal.Diag("checkpoint", err)
+			}
+		}
+	}
+}
+
+// write a line to the journal; the caller must hold the lock.
+func (journal *reposJournal) write(line string, sync bool) (err error) {
+	switch {
+	case journal.f != nil:
+		if _, err = journal.f.WriteString(line); err == nil && sync {
+			err = journal.f.Sync()
+		}
+	case journal.buf != nil:
+		journal.buf.WriteString(line)
+	default:
+		return
+	}
+	if err == nil {
+		journal.off += int64(len(line))
+	}
+	return
+}
+
+// checkpoint replaces the journal with a checkpoint event of the current
+// cursor; the caller must hold the lock.
+func (journal *reposJournal) checkpoint() error {
+	line := fmt.Sprintf("%016x %s %d\n", time.Now().UnixNano(),
+		JournalCheckpoint, journal.off)
+	if journal.buf != nil {
+		journal.buf.Reset()
+		journal.buf.WriteString(line)
+	} else if journal.f != nil {
+		fn := journal.f.Name()
+		f, err := os.OpenFile(fn+".tmp",
+			os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0660)
+		if err != nil {
+			return err
+		}
+		if _, err = f.WriteString(line); err == nil {
+			err = f.Sync()
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), fn)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		journal.f.Close()
+		journal.f = f
+	}
+	journal.base = journal.off
+	journal.off += int64(len(line))
+	return nil
+}
+
+// reader returns a copy of the events from cursor, or the checkpoint that
+// replaced it, to the current end so that it may be read after a checkpoint.
+func (journal *reposJournal) reader(cursor int64) (io.Reader, int64,
+	error) {
+	journal.Lock()
+	defer journal.Unlock()
+	if cursor < 0 || cursor > journal.off {
+		return nil, cursor, os.ErrInvalid
+	}
+	if cursor < journal.base {
+		cursor = journal.base
+	}
+	switch {
+	case journal.f != nil:
+		b := make([]byte, journal.off-cursor)
+		_, err := journal.f.ReadAt(b, cursor-journal.base)
+		if err != nil {
+			return nil, cursor, err
+		}
+		return bytes.NewReader(b), cursor, nil
+	case journal.buf != nil:
+		b := journal.buf.Bytes()[cursor-journal.base : journal.off-
+			journal.base]
+		return bytes.NewReader(append([]byte{}, b...)), cursor, nil
+	}
+	return bytes.NewReader(nil), cursor, nil
+}
+
+// Journal writes the events after cursor to w, each prefixed by the cursor
+// that follows it, and returns the last cursor. If the events after cursor
+// were discarded, these begin with the checkpoint that replaced them.
+func (repos *Repos) Journal(w io.Writer, cursor int64) (int64, error) {
+	r, cursor, err := repos.journal.reader(cursor)
+	if err != nil {
+		return cursor, err
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		cursor += int64(len(line)) + 1
+		fmt.Fprintln(w, cursor, line)
+	}
+	return cursor, scanner.Err()
+}
+
+// LoadJournal opens the store journal for append.
+func (repos *Repos) LoadJournal() error {
+	journal := &repos.journal
+	journal.Lock()
+	defer journal.Unlock()
+	journal.reset()
+	journal.Mutex.Set(repos.dn + "{journal}")
+	if _, ok := repos.storage.(*MemStorage); ok {
+		journal.buf = &bytes.Buffer{}
+		return nil
+	}
+	f, err := os.OpenFile(repos.Join(ReposJournalFN),
+		os.O_RDWR|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	var (
+		t     string
+		event string
+	)
+	fmt.Fscan(f, &t, &event, &journal.base)
+	if event != JournalCheckpoint {
+		journal.base = 0
+	}
+	journal.f = f
+	journal.off = journal.base + fi.Size()
+	return nil
+}
+
+// Recover finishes the journaled stores that weren't done by repeating
+// their links and forwards through the given sender. Those that fail aren't
+// done so that they're retried by the next Recover; it returns the first of
+// their errors.
+func (repos *Repos) Recover(x Sender) error {
+	var pending []string
+	r, _, err := repos.journal.reader(0)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		v := strings.Fields(scanner.Text())
+		if len(v) != 3 {
+			continue
+		}
+		switch v[1] {
+		case JournalStore:
+			pending = append(pending, v[2])
+		case JournalDone:
+			for i, s := range pending {
+				if s == v[2] {
+					pending = append(pending[:i],
+						pending[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		defer repos.InvalidateUsage()
+	}
+	repos.journal.Lock()
+	repos.journal.pending += len(pending)
+	repos.journal.Unlock()
+	for _, s := range pending {
+		if xerr := repos.recoverStore(x, s); xerr != nil {
+			if err == nil {
+				err = &Error{s, xerr.Error()}
+			}
+			continue
+		}
+		repos.journal.append(JournalDone, s)
+	}
+	return err
+}
+
+func (repos *Repos) recoverStore(x Sender, s string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	var sum Sum
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return
+	} else if len(b) != SumSz {
+		return os.ErrInvalid
+	}
+	copy(sum[:], b)
+	fn := repos.Join(sum.PN())
+	f, err := repos.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+	fh := new(FH)
+	if _, err = fh.ReadFrom(f); err != nil {
+		return
+	}
+	repos.Diag("recovering", s)
+	if err = repos.dispatch(x, &sum, fn, f, &fh.Blob); err != nil {
+		return
+	}
+	_, xerr := repos.storage.Stat(fn)
+	repos.Index(&sum, &fh.Blob, xerr == nil, repos.isLinked(&sum, &fh.Blob))
+	return
+}
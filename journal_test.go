@@ -0,0 +1,185 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// testJournal returns the events of the repos journal from cursor.
+func testJournal(t *testing.T, repos *Repos, cursor int64) [][]string {
+	w := new(bytes.Buffer)
+	if _, err := repos.Journal(w, cursor); err != nil {
+		t.Fatal(err)
+	}
+	var events [][]string
+	for _, line := range strings.Split(w.String(), "\n") {
+		// CURSOR TIME EVENT ARGS...
+		if v := strings.Fields(line); len(v) > 2 {
+			events = append(events, v[2:])
+		}
+	}
+	return events
+}
+
+func TestJournalStoreIntent(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	user := newTestUser(t, repos)
+	st := repos.storage
+	repos.storage = testFailStorage{st}
+	if _, err := testStore(repos, x, user, user, "a", "a"); err == nil {
+		t.Fatal("stored to failed storage")
+	}
+	repos.storage = st
+	events := testJournal(t, repos, 0)
+	if len(events) != 2 || events[0][0] != JournalStore ||
+		events[1][0] != JournalDone || events[0][1] != events[1][1] {
+		t.Error("failed store events", events)
+	}
+}
+
+func TestJournalUnlink(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	user := newTestUser(t, repos)
+	if err := repos.Unlink(repos.Join(user.Join("nosuch"))); err == nil {
+		t.Fatal("unlinked nosuch")
+	}
+	for _, v := range testJournal(t, repos, 0) {
+		if v[0] == JournalUnlink {
+			t.Error("journaled failed unlink", v)
+		}
+	}
+}
+
+func TestJournalCheckpoint(t *testing.T) {
+	defer func(max int64) { JournalMax = max }(JournalMax)
+	JournalMax = 1
+	repos := newTestRepos(t, "fs")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	user := newTestUser(t, repos)
+	if _, err := testStore(repos, x, user, user, "a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(repos.Join(ReposJournalFN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("\n")); n != 1 ||
+		!bytes.Contains(b, []byte(JournalCheckpoint)) {
+		t.Fatalf("journal wasn't truncated:\n%s", b)
+	}
+	cursor, err := repos.Journal(ioutil.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor <= int64(len(b)) {
+		t.Error("cursor restarted", cursor)
+	}
+	if events := testJournal(t, repos, 0); len(events) != 1 ||
+		events[0][0] != JournalCheckpoint {
+		t.Error("events before checkpoint", events)
+	}
+	if _, err = repos.Journal(ioutil.Discard, cursor+1); err == nil {
+		t.Error("read beyond the end")
+	}
+	if err = repos.LoadJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, _ := repos.Journal(ioutil.Discard, 0); reloaded != cursor {
+		t.Error("reloaded cursor", reloaded, "of", cursor)
+	}
+	if err = repos.Recover(x); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJournalReader(t *testing.T) {
+	repos := newTestRepos(t, "fs")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	user := newTestUser(t, repos)
+	if _, err := testStore(repos, x, user, user, "a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := repos.journal.reader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos.journal.Lock()
+	err = repos.journal.checkpoint()
+	repos.journal.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Contains(b, []byte(JournalDone)) ||
+		bytes.Contains(b, []byte(JournalCheckpoint)) {
+		t.Errorf("events read after checkpoint %v:\n%s", err, b)
+	}
+}
+
+func TestJournalRecover(t *testing.T) {
+	repos := newTestRepos(t, "fs")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	user := newTestUser(t, repos)
+	sum, err := testStore(repos, x, user, user, "a", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// crash after storing the sum file but before linking it
+	fn := repos.Join(user.Join("a"))
+	if err = repos.Unlink(fn); err != nil {
+		t.Fatal(err)
+	}
+	repos.journal.append(JournalStore, sum.FullString())
+	if err = repos.LoadJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if err = repos.Recover(x); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := testContent(repos, fn); err != nil || s != "a" {
+		t.Error("unrecovered", s, err)
+	}
+	events := testJournal(t, repos, 0)
+	if v := events[len(events)-1]; v[0] != JournalDone ||
+		v[1] != sum.FullString() {
+		t.Error("recovery wasn't done", v)
+	}
+}
+
+func TestJournalRecoverFailed(t *testing.T) {
+	repos := newTestRepos(t, "fs")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	// crash after storing a sum file that has since been corrupted
+	f := repos.tmp.New()
+	defer repos.tmp.Free(f)
+	f.WriteString("corrupt")
+	sum := NewSumOf(strings.NewReader("corrupt"))
+	if err := repos.storage.Store(f.Name(),
+		repos.Join(sum.PN())); err != nil {
+		t.Fatal(err)
+	}
+	repos.journal.append(JournalStore, sum.FullString())
+	for i := 0; i < 2; i++ {
+		if err := repos.Recover(x); err == nil {
+			t.Fatal(i, "recovered corrupt sum file")
+		}
+	}
+	for _, v := range testJournal(t, repos, 0) {
+		if v[0] == JournalDone {
+			t.Error("failed recovery was done", v)
+		}
+	}
+}
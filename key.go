@@ -16,6 +16,7 @@ import (
 
 	"github.com/agl/ed25519"
 	"github.com/apptimistco/asn/debug/accumulator"
+	"github.com/apptimistco/asn/debug/mutex"
 	"golang.org/x/crypto/nacl/box"
 	"gopkg.in/yaml.v1"
 )
@@ -212,30 +213,44 @@ func (x PubEncrList) Has(v interface{}) bool {
 	return false
 }
 
+// pubEncrLists serializes the changes of key lists, which replace rather than
+// modify their keys, with the Keys of those ranging over them.
+var pubEncrLists mutex.Mutex
+
+// Keys returns the list as of now; it's unchanged by later KeyAdd, KeyDel,
+// ReadFrom or Reset of the list.
+func (l *PubEncrList) Keys() PubEncrList {
+	if l == nil {
+		return nil
+	}
+	pubEncrLists.Lock()
+	defer pubEncrLists.Unlock()
+	return *l
+}
+
+// KeyAdd appends the key to a copy of the list.
 func (l *PubEncrList) KeyAdd(k *PubEncr) {
+	pubEncrLists.Lock()
+	defer pubEncrLists.Unlock()
 	for _, x := range *l {
 		if bytes.Equal(x.Bytes(), k.Bytes()) {
 			return
 		}
 	}
-	*l = append(*l, *k)
+	nl := make(PubEncrList, 0, len(*l)+1)
+	nl = append(nl, (*l)...)
+	*l = append(nl, *k)
 }
 
+// KeyDel removes the key from a copy of the list.
 func (l *PubEncrList) KeyDel(k *PubEncr) {
+	pubEncrLists.Lock()
+	defer pubEncrLists.Unlock()
 	for i, x := range *l {
 		if bytes.Equal(x.Bytes(), k.Bytes()) {
-			if i == 0 {
-				if len(*l) == 1 {
-					*l = []PubEncr(*l)[:0]
-				} else {
-					*l = []PubEncr(*l)[1:]
-				}
-			} else if i == len(*l) {
-				*l = []PubEncr(*l)[:i-1]
-			} else {
-				*l = append([]PubEncr(*l)[:i-1],
-					[]PubEncr(*l)[i+1:]...)
-			}
+			nl := make(PubEncrList, 0, len(*l)-1)
+			nl = append(nl, (*l)[:i]...)
+			*l = append(nl, (*l)[i+1:]...)
 			return
 		}
 	}
@@ -251,12 +266,12 @@ func (x *PubEncr) ReadFrom(r io.Reader) (int64, error) {
 	return int64(i), err
 }
 
+// ReadFrom replaces the list with the keys read.
 func (x *PubEncrList) ReadFrom(r io.Reader) (int64, error) {
 	if x == nil {
 		x = new(PubEncrList)
-	} else {
-		*x = (*x)[:0]
 	}
+	var nl PubEncrList
 	for {
 		var (
 			k PubEncr
@@ -268,15 +283,23 @@ func (x *PubEncrList) ReadFrom(r io.Reader) (int64, error) {
 			if err == io.EOF {
 				err = nil
 			}
+			pubEncrLists.Lock()
+			*x = nl
+			pubEncrLists.Unlock()
 			return n, err
 		}
-		*x = append(*x, k)
+		nl = append(nl, k)
 	}
 }
 
-func (x *PubAuth) Reset()     { *x = PubAuth{} }
-func (x *PubEncr) Reset()     { *x = PubEncr{} }
-func (x *PubEncrList) Reset() { *x = PubEncrList{} }
+func (x *PubAuth) Reset() { *x = PubAuth{} }
+func (x *PubEncr) Reset() { *x = PubEncr{} }
+
+func (x *PubEncrList) Reset() {
+	pubEncrLists.Lock()
+	*x = PubEncrList{}
+	pubEncrLists.Unlock()
+}
 
 func (x *Nonce) Recast() *[NonceSz]byte { return (*[NonceSz]byte)(x) }
 
@@ -0,0 +1,55 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestPubEncrListKeys is meaningful with -race.
+func TestPubEncrListKeys(t *testing.T) {
+	const n = 64
+	var keys []*PubEncr
+	for i := 0; i < n; i++ {
+		k, _, err := NewRandomEncrKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	l := new(PubEncrList)
+	for _, k := range keys {
+		l.KeyAdd(k)
+	}
+	snapshot := l.Keys()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for _, k := range keys {
+			l.KeyDel(k)
+			l.KeyAdd(k)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if len(l.Keys()) < n-1 {
+				t.Error("short list")
+			}
+		}
+	}()
+	wg.Wait()
+	if len(snapshot) != n || snapshot[0] != *keys[0] {
+		t.Error("changed snapshot")
+	}
+	if l.KeyDel(keys[0]); l.Keys().Has(keys[0]) || len(l.Keys()) != n-1 {
+		t.Error("deleted", len(l.Keys()))
+	}
+	if l.Reset(); len(l.Keys()) != 0 {
+		t.Error("reset", len(l.Keys()))
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/apptimistco/asn/debug/mutex"
+)
+
+const (
+	ListenFdsStart = 3
+	ListenFdsEnv   = "LISTEN_FDS"
+	ListenNamesEnv = "LISTEN_FDNAMES"
+	ListenPidEnv   = "LISTEN_PID"
+)
+
+// InheritedListener is a listening socket passed to this process by systemd
+// socket activation or by the server that handed off to this one.
+type InheritedListener struct {
+	name string
+	ln   Listener
+}
+
+var inherited struct {
+	mutex.Mutex
+	once sync.Once
+	l    []*InheritedListener
+	err  error
+}
+
+// InheritListeners returns the sockets passed through the LISTEN_FDS
+// environment. These are only parsed once per process and the LISTEN_*
+// variables are removed so that filters exec'd by sessions don't also
+// claim them.
+//
+// Systemd sets LISTEN_PID to the activated process; a server handoff can't
+// know the pid of its successor so it leaves LISTEN_PID empty.
+func InheritListeners() []*InheritedListener {
+	inherited.once.Do(func() {
+		inherited.Mutex.Set("inherited")
+		inherited.l, inherited.err = inheritListeners()
+		for _, env := range []string{
+			ListenFdsEnv,
+			ListenNamesEnv,
+			ListenPidEnv,
+		} {
+			os.Unsetenv(env)
+		}
+	})
+	return inherited.l
+}
+
+func inheritListeners() (l []*InheritedListener, err error) {
+	sfds := os.Getenv(ListenFdsEnv)
+	if sfds == "" {
+		return
+	}
+	if spid := os.Getenv(ListenPidEnv); spid != "" {
+		pid, err := strconv.Atoi(spid)
+		if err != nil || pid != os.Getpid() {
+			return nil, nil
+		}
+	}
+	nfds, err := strconv.Atoi(sfds)
+	if err != nil {
+		return nil, &Error{ListenFdsEnv, err.Error()}
+	}
+	names := strings.Split(os.Getenv(ListenNamesEnv), ":")
+	for i := 0; i < nfds; i++ {
+		fd := ListenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		nl, ferr := net.FileListener(f)
+		f.Close()
+		if ferr != nil {
+			err = &Error{name, ferr.Error()}
+			return
+		}
+		ln, ok := nl.(Listener)
+		if !ok {
+			nl.Close()
+			err = &Error{name, "unsupported listener"}
+			return
+		}
+		l = append(l, &InheritedListener{name, ln})
+	}
+	return
+}
+
+// Inherit returns and claims the inherited listener bound to the given
+// address; otherwise, nil.
+func Inherit(addr net.Addr) Listener {
+	InheritListeners()
+	inherited.Lock()
+	defer inherited.Unlock()
+	for i, p := range inherited.l {
+		if p == nil {
+			continue
+		}
+		if SameAddr(p.ln.Addr(), addr) {
+			inherited.l[i] = nil
+			return p.ln
+		}
+	}
+	return nil
+}
+
+// InheritErr returns any error encountered parsing inherited listeners.
+func InheritErr() error {
+	InheritListeners()
+	return inherited.err
+}
+
+// Uninherited closes and forgets all inherited listeners that weren't
+// claimed by the configured listen URLs, returning their names.
+func Uninherited() (names []string) {
+	inherited.Lock()
+	defer inherited.Unlock()
+	for i, p := range inherited.l {
+		if p != nil {
+			names = append(names, p.name)
+			p.ln.Close()
+			inherited.l[i] = nil
+		}
+	}
+	return
+}
+
+// SameAddr compares two TCP or Unix socket addresses where the unspecified
+// IP (e.g. ":6080") matches either IPv4 or IPv6 any-address.
+func SameAddr(a, b net.Addr) bool {
+	switch ta := a.(type) {
+	case *net.TCPAddr:
+		tb, ok := b.(*net.TCPAddr)
+		if !ok || ta.Port != tb.Port {
+			return false
+		}
+		if len(ta.IP) == 0 || ta.IP.IsUnspecified() {
+			return len(tb.IP) == 0 || tb.IP.IsUnspecified()
+		}
+		return ta.IP.Equal(tb.IP)
+	case *net.UnixAddr:
+		tb, ok := b.(*net.UnixAddr)
+		return ok && ta.Name == tb.Name
+	}
+	return false
+}
+
+// ListenerFile returns a dup of the listener's socket that remains open after
+// the listener is closed. Unix socket files aren't removed on close as these
+// now belong to the successor.
+func ListenerFile(ln Listener) (*os.File, error) {
+	switch t := ln.(type) {
+	case *net.TCPListener:
+		return t.File()
+	case *net.UnixListener:
+		t.SetUnlinkOnClose(false)
+		return t.File()
+	}
+	return nil, &Error{ln.Addr().String(), "can't handoff listener"}
+}
+
+// Handoff re-executes this program with the same arguments and the listening
+// sockets of this server so that the successor may accept new connections
+// while this server drains its sessions. The successor matches these sockets
+// to its configured listen URLs by address, the LISTEN_FDNAMES are just the
+// URL schemes as systemd doesn't permit ':' in names.
+func (srv *Server) Handoff() (err error) {
+	var (
+		files []*os.File
+		names []string
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+		files = nil
+	}()
+	srv.Lock()
+	for _, l := range srv.listeners {
+		if l == nil {
+			continue
+		}
+		var f *os.File
+		if f, err = ListenerFile(l.ln); err != nil {
+			srv.Unlock()
+			return
+		}
+		files = append(files, f)
+		names = append(names, l.url.Scheme)
+	}
+	srv.Unlock()
+	if len(files) == 0 {
+		return &Error{srv.cmd.Cfg.Name, "no listeners to handoff"}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "LISTEN_") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		ListenFdsEnv+"="+strconv.Itoa(len(files)),
+		ListenNamesEnv+"="+strings.Join(names, ":"))
+	cmd.ExtraFiles = files
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	srv.Log("handoff to", cmd.Process.Pid)
+	cmd.Process.Release()
+	srv.Lock()
+	for _, l := range srv.listeners {
+		if l != nil {
+			// successor owns the socket file now
+			l.clean = ""
+		}
+	}
+	srv.Unlock()
+	return
+}
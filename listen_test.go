@@ -0,0 +1,124 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestInheritListenersEnv(t *testing.T) {
+	defer func() {
+		os.Unsetenv(ListenFdsEnv)
+		os.Unsetenv(ListenPidEnv)
+	}()
+	os.Unsetenv(ListenFdsEnv)
+	if l, err := inheritListeners(); l != nil || err != nil {
+		t.Error("without", ListenFdsEnv, l, err)
+	}
+	os.Setenv(ListenFdsEnv, "1")
+	os.Setenv(ListenPidEnv, strconv.Itoa(os.Getpid()+1))
+	if l, err := inheritListeners(); l != nil || err != nil {
+		t.Error("other", ListenPidEnv, l, err)
+	}
+	os.Setenv(ListenFdsEnv, "one")
+	os.Setenv(ListenPidEnv, strconv.Itoa(os.Getpid()))
+	if _, err := inheritListeners(); err == nil {
+		t.Error("accepted invalid", ListenFdsEnv)
+	}
+}
+
+func TestInherit(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unused, err := net.ListenTCP("tcp",
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	InheritListeners()
+	inherited.Lock()
+	inherited.l = []*InheritedListener{
+		&InheritedListener{"tcp", ln},
+		&InheritedListener{"unused", unused},
+	}
+	inherited.Unlock()
+	addr := ln.Addr().(*net.TCPAddr)
+	// the same port of another IP is never that of the inherited
+	other := &net.TCPAddr{
+		IP:   net.IPv4(127, 0, 0, 2),
+		Port: unused.Addr().(*net.TCPAddr).Port,
+	}
+	if l := Inherit(other); l != nil {
+		t.Error("inherited", l.Addr(), "for", other)
+	}
+	if l := Inherit(addr); l != ln {
+		t.Fatal("didn't inherit", addr)
+	}
+	if l := Inherit(addr); l != nil {
+		t.Error("inherited", addr, "twice")
+	}
+	ln.Close()
+	names := Uninherited()
+	if len(names) != 1 || names[0] != "unused" {
+		t.Error("uninherited", names)
+	}
+	if _, err = unused.Accept(); err == nil {
+		t.Error("unclaimed listener wasn't closed")
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	for _, x := range []struct {
+		a, b net.Addr
+		same bool
+	}{
+		{&net.TCPAddr{Port: 6080}, &net.TCPAddr{Port: 6080}, true},
+		{&net.TCPAddr{Port: 6080},
+			&net.TCPAddr{IP: net.IPv6unspecified, Port: 6080}, true},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6080},
+			&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6080}, true},
+		{&net.TCPAddr{Port: 6080}, &net.TCPAddr{Port: 6081}, false},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6080},
+			&net.TCPAddr{Port: 6080}, false},
+		{&net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"},
+			&net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"}, true},
+		{&net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"},
+			&net.UnixAddr{Name: "/tmp/b.sock", Net: "unix"}, false},
+		{&net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"},
+			&net.TCPAddr{Port: 6080}, false},
+	} {
+		if SameAddr(x.a, x.b) != x.same {
+			t.Error(x.a, x.b, "expected", x.same)
+		}
+	}
+}
+
+func TestListenerFile(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ListenerFile(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ln.Close()
+	nl, err := net.FileListener(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nl.Close()
+	c, err := net.Dial("tcp", nl.Addr().String())
+	if err != nil {
+		t.Fatal("handed off listener isn't open:", err)
+	}
+	c.Close()
+}
@@ -0,0 +1,66 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lsEntry is a listed reference of the named sum file or link.
+type lsEntry struct {
+	ref string
+	fn  string
+	t   time.Time
+}
+
+type lsEntries []*lsEntry
+
+func (l lsEntries) Len() int           { return len(l) }
+func (l lsEntries) Less(i, j int) bool { return l[i].ref < l[j].ref }
+func (l lsEntries) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// lsByTime orders entries latest first.
+type lsByTime struct{ lsEntries }
+
+func (l lsByTime) Less(i, j int) bool {
+	return l.lsEntries[i].t.After(l.lsEntries[j].t)
+}
+
+// lsLong writes a line of the entry's abbreviated sum, content size, owner,
+// author, blob time and reference.
+func (repos *Repos) lsLong(w io.Writer, e *lsEntry) error {
+	f, err := repos.Open(e.fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fh := new(FH)
+	n, err := fh.ReadFrom(f)
+	if err != nil {
+		return err
+	}
+	var s string
+	if _, ok := derivedTime(e.fn); ok {
+		s = filepath.Base(e.fn)[17:]
+	} else if strings.HasPrefix(e.ref, "$") {
+		s = e.ref[1:]
+	} else {
+		f.Seek(0, os.SEEK_SET)
+		s = NewSumOf(f).FullString()[:16]
+	}
+	_, err = fmt.Fprintf(w, "%s %d %s %s %s %s\n", s, fi.Size()-n,
+		fh.Blob.Owner.FullString()[:16], fh.Blob.Author.FullString()[:16],
+		fh.Blob.Time.Format(time.RFC3339), e.ref)
+	return err
+}
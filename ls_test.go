@@ -0,0 +1,98 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLS returns the lines of an ls with the given arguments.
+func testLS(t *testing.T, ses *Ses, args ...string) ([]string, error) {
+	var req Req
+	s, err := testAck(t, ses, ses.ExecLS(req, nil, args...))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(s, "\n"), nil
+}
+
+func TestExecLS(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	author := newTestUser(t, repos)
+	_, err := testStore(repos, x, owner, owner, AsnEditors+"/"+
+		author.FullString(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, name := range []string{"b", "a", "c"} {
+		_, err = testStoreAt(repos, x, owner, author, "ls/"+name,
+			name+name, now.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ses := newTestSes(repos, owner)
+	refs := func(args ...string) (l []string) {
+		v, err := testLS(t, ses, args...)
+		if err != nil {
+			t.Fatal(args, err)
+		}
+		for _, line := range v {
+			if i := strings.Index(line, "ls/"); i >= 0 {
+				l = append(l, line[i:])
+			}
+		}
+		return
+	}
+	for _, c := range []struct {
+		args []string
+		refs string
+	}{
+		{[]string{"~/ls/*"}, "ls/a ls/b ls/c"},
+		{[]string{"-r", "~/ls/*"}, "ls/c ls/b ls/a"},
+		{[]string{"-t", "~/ls/*"}, "ls/c ls/a ls/b"},
+		{[]string{"-tr", "~/ls/*"}, "ls/b ls/a ls/c"},
+		{[]string{"-n", "2", "~/ls/*"}, "ls/a ls/b"},
+		{[]string{"-t", "-n", "1", "~/ls/*"}, "ls/c"},
+	} {
+		if s := strings.Join(refs(c.args...), " "); s != c.refs {
+			t.Error(c.args, s)
+		}
+	}
+	v, err := testLS(t, ses, "-l", "~/ls/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line string
+	for _, s := range v {
+		if strings.HasSuffix(s, "ls/a") {
+			line = s
+		}
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 6 || len(fields[0]) != 16 || fields[1] != "2" ||
+		fields[2] != owner.FullString()[:16] ||
+		fields[3] != author.FullString()[:16] ||
+		fields[4] != now.Add(time.Second).Format(time.RFC3339) {
+		t.Errorf("long: %q", line)
+	}
+	for _, args := range [][]string{
+		{"-x", "~/ls/*"},
+		{"-n"},
+		{"-n", "-1", "~/ls/*"},
+		{"-n", "x", "~/ls/*"},
+	} {
+		var req Req
+		if _, ok := ses.ExecLS(req, nil, args...).(*Usage); !ok {
+			t.Error("usage", args)
+		}
+	}
+}
@@ -147,10 +147,6 @@ func IsBlob(fi os.FileInfo) bool {
 	return !fi.IsDir() && len(fn) == 2*(SumSz-1) && IsHex(fn)
 }
 
-func IsBridge(fn string) bool {
-	return filepath.Base(filepath.Dir(fn)) == "bridge"
-}
-
 func IsHex(s string) bool {
 	if s == "" {
 		return false
@@ -0,0 +1,360 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apptimistco/asn/debug/file"
+	"github.com/apptimistco/asn/debug/mutex"
+)
+
+const memPre = "mem_"
+
+// MemTmpRoot is the memory file system for the MemStorage tmp directory; if
+// it doesn't exist, that's made in the default directory for temporary files.
+var MemTmpRoot = "/dev/shm"
+
+// MemStorage is a Repos backend that keeps all blobs in memory. Pathnames are
+// the same as those of FSStorage but only serve as map keys; links share the
+// blob of their sum file.
+//
+// Open copies the blob to an unlinked file of a private temporary directory
+// that is also used for the Repos tmp files and uploads. This directory is
+// made in MemTmpRoot so that these files are also kept in memory; nothing is
+// written to the repos directory.
+type MemStorage struct {
+	mutex.Mutex
+	dn    string
+	tmpdn string
+	files map[string]*memBlob
+	dirs  map[string]struct{}
+}
+
+type memBlob struct {
+	data  []byte
+	pn    string // sum file
+	nlink int
+	mtime time.Time
+}
+
+func (b *memBlob) Time() (t time.Time) {
+	if int64(len(b.data)) > BlobTimeOff {
+		r := bytes.NewReader(b.data[BlobTimeOff:])
+		(NBOReader{r}).ReadNBO(&t)
+	}
+	return
+}
+
+type memFileInfo struct {
+	name  string
+	size  int64
+	dir   bool
+	mtime time.Time
+}
+
+func (fi *memFileInfo) IsDir() bool        { return fi.dir }
+func (fi *memFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+func (fi *memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0770
+	}
+	return 0660
+}
+
+func NewMemStorage(dn string) (*MemStorage, error) {
+	root := ""
+	if fi, err := os.Stat(MemTmpRoot); err == nil && fi.IsDir() {
+		root = MemTmpRoot
+	}
+	tmpdn, err := ioutil.TempDir(root, AsnStr+"_"+filepath.Base(dn)+"_")
+	if err != nil {
+		return nil, err
+	}
+	mem := &MemStorage{
+		dn:    dn,
+		tmpdn: tmpdn,
+		files: make(map[string]*memBlob),
+		dirs:  make(map[string]struct{}),
+	}
+	mem.Mutex.Set(dn + "{mem}")
+	return mem, nil
+}
+
+func (mem *MemStorage) Filter(epoch time.Time,
+	f func(fn string) error) error {
+	var fns []string
+	mem.Lock()
+	for fn, b := range mem.files {
+		if fn == b.pn && (epoch.IsZero() || b.Time().After(epoch)) {
+			fns = append(fns, fn)
+		}
+	}
+	mem.Unlock()
+	sort.Strings(fns)
+	for _, fn := range fns {
+		if err := f(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mem *MemStorage) Glob(pattern string) (matches []string, err error) {
+	if _, err = filepath.Match(pattern, ""); err != nil {
+		return
+	}
+	mem.Lock()
+	names := mem.names()
+	mem.Unlock()
+	for _, name := range names {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			matches = append(matches, name)
+		}
+	}
+	return
+}
+
+func (mem *MemStorage) Link(src, dst string) error {
+	mem.Lock()
+	defer mem.Unlock()
+	b, ok := mem.files[src]
+	if !ok {
+		return &os.PathError{Op: "link", Path: src, Err: os.ErrNotExist}
+	}
+	if old := mem.files[dst]; old == b {
+		return nil
+	} else if old != nil {
+		old.nlink -= 1
+	}
+	mem.files[dst] = b
+	b.nlink += 1
+	return nil
+}
+
+func (mem *MemStorage) Mkdir(pn string) error {
+	mem.Lock()
+	defer mem.Unlock()
+	mem.dirs[pn] = struct{}{}
+	return nil
+}
+
+// names returns the sorted pathnames of all files and directories, including
+// those implied by files. The caller must hold the lock.
+func (mem *MemStorage) names() []string {
+	set := make(map[string]struct{})
+	add := func(pn string) {
+		for pn != mem.dn && strings.HasPrefix(pn, mem.dn+ReposPS) {
+			if _, ok := set[pn]; ok {
+				return
+			}
+			set[pn] = struct{}{}
+			pn = filepath.Dir(pn)
+		}
+	}
+	for pn := range mem.files {
+		add(pn)
+	}
+	for pn := range mem.dirs {
+		add(pn)
+	}
+	names := make([]string, 0, len(set))
+	for pn := range set {
+		names = append(names, pn)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (mem *MemStorage) Nlink(pn string) (int, error) {
+	mem.Lock()
+	defer mem.Unlock()
+	b, ok := mem.files[pn]
+	if !ok {
+		return 0, &os.PathError{Op: "stat", Path: pn, Err: os.ErrNotExist}
+	}
+	return b.nlink, nil
+}
+
+func (mem *MemStorage) Open(pn string) (*file.File, error) {
+	mem.Lock()
+	b, ok := mem.files[pn]
+	mem.Unlock()
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: pn,
+			Err: os.ErrNotExist}
+	}
+	f, err := ioutil.TempFile(mem.tmpdn, memPre)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	if _, err = f.Write(b.data); err == nil {
+		_, err = f.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &file.File{File: f}, nil
+}
+
+func (mem *MemStorage) RemoveAll(pn string) error {
+	mem.Lock()
+	defer mem.Unlock()
+	for fn, b := range mem.files {
+		if fn == pn || strings.HasPrefix(fn, pn+ReposPS) {
+			delete(mem.files, fn)
+			b.nlink -= 1
+		}
+	}
+	for dn := range mem.dirs {
+		if dn == pn || strings.HasPrefix(dn, pn+ReposPS) {
+			delete(mem.dirs, dn)
+		}
+	}
+	return nil
+}
+
+// Reset forgets all blobs and removes the temporary directory.
+func (mem *MemStorage) Reset() {
+	mem.Lock()
+	defer mem.Unlock()
+	os.RemoveAll(mem.tmpdn)
+	mem.files = make(map[string]*memBlob)
+	mem.dirs = make(map[string]struct{})
+}
+
+func (mem *MemStorage) Search(x string) (match string, err error) {
+	prefix := mem.dn + ReposPS + filepath.Join(x[:ReposTopSz],
+		x[ReposTopSz:])
+	mem.Lock()
+	defer mem.Unlock()
+	for fn, b := range mem.files {
+		if fn == b.pn && strings.HasPrefix(fn, prefix) {
+			if match != "" {
+				return "", ErrAmbiguos
+			}
+			match = fn
+		}
+	}
+	return
+}
+
+func (mem *MemStorage) Stat(pn string) (os.FileInfo, error) {
+	mem.Lock()
+	defer mem.Unlock()
+	if b, ok := mem.files[pn]; ok {
+		return &memFileInfo{
+			name:  filepath.Base(pn),
+			size:  int64(len(b.data)),
+			mtime: b.mtime,
+		}, nil
+	}
+	if _, ok := mem.dirs[pn]; ok || pn == mem.dn {
+		return &memFileInfo{name: filepath.Base(pn), dir: true}, nil
+	}
+	for fn := range mem.files {
+		if strings.HasPrefix(fn, pn+ReposPS) {
+			return &memFileInfo{name: filepath.Base(pn), dir: true},
+				nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: pn, Err: os.ErrNotExist}
+}
+
+func (mem *MemStorage) Store(tmpfn, pn string) error {
+	data, err := ioutil.ReadFile(tmpfn)
+	if err != nil {
+		return err
+	}
+	mem.Lock()
+	defer mem.Unlock()
+	if _, ok := mem.files[pn]; ok {
+		return os.ErrExist
+	}
+	mem.files[pn] = &memBlob{
+		data:  data,
+		pn:    pn,
+		nlink: 1,
+		mtime: time.Now(),
+	}
+	return nil
+}
+
+// TmpDir returns the directory that should be used for Repos tmp files.
+func (mem *MemStorage) TmpDir() string {
+	return mem.tmpdn
+}
+
+func (mem *MemStorage) Unlink(pn string) error {
+	mem.Lock()
+	defer mem.Unlock()
+	b, ok := mem.files[pn]
+	if !ok {
+		return &os.PathError{Op: "unlink", Path: pn,
+			Err: os.ErrNotExist}
+	}
+	delete(mem.files, pn)
+	b.nlink -= 1
+	return nil
+}
+
+func (mem *MemStorage) Users(f func(keystr string) error) error {
+	var keystrs []string
+	mem.Lock()
+	for _, pn := range mem.names() {
+		rel := strings.Split(pn[len(mem.dn)+1:], ReposPS)
+		if len(rel) == 2 && len(rel[0]) == ReposTopSz &&
+			IsUser(rel[1]) {
+			keystrs = append(keystrs, rel[0]+rel[1])
+		}
+	}
+	mem.Unlock()
+	for _, keystr := range keystrs {
+		if err := f(keystr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk calls f with each file at or below pn in lexical order.
+func (mem *MemStorage) Walk(pn string, f func(pn string) error) error {
+	var fns []string
+	mem.Lock()
+	if _, ok := mem.files[pn]; ok {
+		fns = append(fns, pn)
+	} else {
+		for fn := range mem.files {
+			if strings.HasPrefix(fn, pn+ReposPS) {
+				fns = append(fns, fn)
+			}
+		}
+	}
+	mem.Unlock()
+	if len(fns) == 0 {
+		if _, err := mem.Stat(pn); err != nil {
+			return err
+		}
+	}
+	sort.Strings(fns)
+	for _, fn := range fns {
+		if err := f(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMemStorageTmpDir(t *testing.T) {
+	defer func(root string) { MemTmpRoot = root }(MemTmpRoot)
+	root, err := ioutil.TempDir("", "asn_test_shm_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	MemTmpRoot = root
+	mem, err := NewMemStorage("mem.repos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(mem.TmpDir()) != root {
+		t.Error("tmp dir", mem.TmpDir(), "isn't in", root)
+	}
+	mem.Reset()
+	MemTmpRoot = filepath.Join(root, "nosuch")
+	if mem, err = NewMemStorage("mem.repos"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(mem.TmpDir(), MemTmpRoot) {
+		t.Error("tmp dir", mem.TmpDir(), "in missing", MemTmpRoot)
+	}
+	if _, err = os.Stat(mem.TmpDir()); err != nil {
+		t.Error(err)
+	}
+	mem.Reset()
+}
+
+func TestMemStorageNoFiles(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	if _, err := testStore(repos, x, owner, owner, "a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := repos.Open(repos.Join(owner.Join("a")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	filepath.Walk(repos.dn, func(fn string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			t.Error("mem storage wrote", fn)
+		}
+		return nil
+	})
+}
+
+func TestReposSetInvalid(t *testing.T) {
+	var repos Repos
+	if err := repos.Set(1.0); err != os.ErrInvalid {
+		t.Error("set float:", err)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/apptimistco/asn/debug/file"
+)
+
+// moderated returns true if the owner's moderators must approve the author's
+// messages and named blobs; never those of the owner, admin or server.
+func (repos *Repos) moderated(owner, author *User) bool {
+	if len(owner.cache.Moderators().Keys()) == 0 ||
+		author.MayApproveFor(owner) {
+		return false
+	}
+	switch author.key {
+	case owner.key, *repos.svc.Admin.Pub.Encr, *repos.svc.Server.Pub.Encr:
+		return false
+	}
+	return true
+}
+
+// pend queues an unapproved message or named blob of a moderated owner as
+// OWNER/asn/pending/DERIVED, for those moderators signed-in later, and sends
+// it to those signed-in now; this will panic on link error so the calling
+// function must recover.
+func (repos *Repos) pend(x Sender, sum *Sum, sumFN string, f *file.File,
+	blob *Blob) {
+	owner := repos.users.User(&blob.Owner)
+	repos.LN(sumFN, repos.Join(owner.Join(AsnPending, blob.FN(sum))))
+	for _, k := range owner.cache.Moderators().Keys() {
+		x.Send(&k, f)
+	}
+}
+
+// pending returns the queue link of the given message if it's unapproved.
+func (repos *Repos) pending(sum *Sum, blob *Blob) string {
+	owner := repos.users.User(&blob.Owner)
+	if owner == nil {
+		return ""
+	}
+	fn := repos.Join(owner.Join(AsnPending, blob.FN(sum)))
+	if _, err := repos.storage.Stat(fn); err != nil {
+		return ""
+	}
+	return fn
+}
+
+// approveNamed links an approved blob as its owner's current version, unless
+// that's newer, then sends it to its author and watchers; this will panic on
+// link error so the calling function must recover.
+func (repos *Repos) approveNamed(x Sender, sum *Sum, sumFN string,
+	f *file.File, blob *Blob) {
+	owner := repos.users.User(&blob.Owner)
+	author := repos.users.User(&blob.Author)
+	fn := repos.Join(owner.Join(blob.Name))
+	repos.cas.Lock()
+	defer repos.cas.Unlock()
+	if t, err := repos.BlobTime(fn); err == nil {
+		if t.After(blob.Time) {
+			repos.historyLN(sumFN, owner, blob, sum)
+			return
+		}
+		repos.Unlink(fn)
+	}
+	repos.LN(sumFN, fn)
+	repos.Index(sum, blob, false, true)
+	repos.historyLN(sumFN, owner, blob, sum)
+	x.Send(&author.key, f)
+	repos.watched(x, sum, blob, f)
+}
+
+// Pending returns the queued messages of the owner, oldest first.
+func (repos *Repos) Pending(slogin string, owner *User) (l lsEntries,
+	err error) {
+	err = repos.storage.Walk(repos.Join(owner.Join(AsnPending)),
+		func(fn string) error {
+			if t, ok := derivedTime(fn); ok {
+				l = append(l, &lsEntry{repos.FN2Ref(slogin, fn), fn, t})
+			}
+			return nil
+		})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	sort.Stable(sort.Reverse(lsByTime{l}))
+	return
+}
+
+// Rejections removes the listed messages from the queues of the owners that
+// the author moderates then links and sends the rejection, with its reason,
+// to the author of each.
+func (repos *Repos) Rejections(x Sender, sum *Sum, sumFN string,
+	f *file.File, blob *Blob) error {
+	var sums Sums
+	if _, err := BlobSeek(f); err != nil {
+		return err
+	}
+	// read all of the sums before sending f
+	br := bufio.NewReader(f)
+	if _, err := br.ReadString('\n'); err != nil {
+		return &Error{blob.Name, "missing reason"}
+	}
+	for {
+		var rsum Sum
+		if _, err := io.ReadFull(br, rsum[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		sums = append(sums, rsum)
+	}
+	moderator := repos.users.User(&blob.Author)
+	notified := make(map[*User]struct{})
+	for i := range sums {
+		rsum := &sums[i]
+		m, err := repos.Open(repos.Join(rsum.PN()))
+		if err != nil {
+			repos.Diag(rsum, err)
+			continue
+		}
+		fh := new(FH)
+		_, err = fh.ReadFrom(m)
+		m.Close()
+		if err != nil {
+			return err
+		}
+		owner := repos.users.User(&fh.Blob.Owner)
+		author := repos.users.User(&fh.Blob.Author)
+		fn := repos.pending(rsum, &fh.Blob)
+		switch {
+		case owner == nil, author == nil:
+			continue
+		case fn == "":
+			repos.Diag(rsum, "not pending")
+			continue
+		case !moderator.MayApproveFor(owner):
+			repos.Diag(moderator.keystr[:8]+"...",
+				"may not reject for", owner.keystr[:8]+"...")
+			continue
+		}
+		repos.Unlink(fn)
+		if _, ok := notified[author]; ok {
+			continue
+		}
+		notified[author] = struct{}{}
+		x.Send(&author.key, f)
+		repos.LN(sumFN, repos.Join(author.Join(AsnMessages,
+			blob.FN(sum))))
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExecReject(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	forum := newTestUser(t, repos)
+	moderator := newTestUser(t, repos)
+	author := newTestUser(t, repos)
+	_, err := testStore(repos, x, forum, forum,
+		AsnModerators+"/"+moderator.FullString(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pendingFN := repos.Join(forum.Join(AsnPending, "*"))
+	pending := "~" + forum.FullString() + "/" + AsnPending + "/*"
+	queued := func(name string) {
+		if _, err := testStore(repos, x, forum, author, name,
+			name); err != nil {
+			t.Fatal(err)
+		}
+		if l, _ := repos.storage.Glob(pendingFN); len(l) != 1 {
+			t.Fatal("queued", l)
+		}
+	}
+	queued("a")
+	ses := newTestSes(repos, moderator)
+	if _, ok := ses.ExecReject(strings.NewReader(""), pending,
+		"-").(*Usage); !ok {
+		t.Error("rejected without reason")
+	}
+	if _, ok := ses.ExecReject(nil, "-", "spam").(*Usage); !ok {
+		t.Error("rejected nothing")
+	}
+	// only the first line of input is the reason
+	v := ses.ExecReject(strings.NewReader("spam\nmore\n"), pending, "-")
+	sum, ok := v.(*Sum)
+	if !ok {
+		t.Fatal(v)
+	}
+	if l, _ := repos.storage.Glob(pendingFN); len(l) != 0 {
+		t.Error("still queued", l)
+	}
+	s, err := testContent(repos, repos.Join(sum.PN()))
+	if err != nil || !strings.HasPrefix(s, "spam\n") ||
+		len(s) != len("spam\n")+SumSz {
+		t.Errorf("rejection %q %v", s, err)
+	}
+	queued("b")
+	v = ses.ExecReject(nil, pending, "-", "off", "topic")
+	if _, ok = v.(*Sum); !ok {
+		t.Error("rejected with reason arguments", v)
+	}
+	if l, _ := repos.storage.Glob(pendingFN); len(l) != 0 {
+		t.Error("still queued", l)
+	}
+	if v = ses.ExecReject(nil, pending, "-", "empty"); v == nil {
+		t.Error("rejected empty queue")
+	} else if _, ok = v.(*Sum); ok {
+		t.Error("rejected empty queue", v)
+	}
+}
+
+func TestModerated(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	forum := newTestUser(t, repos)
+	moderator := newTestUser(t, repos)
+	author := newTestUser(t, repos)
+	_, err := testStore(repos, x, forum, forum,
+		AsnModerators+"/"+moderator.FullString(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := repos.users.User(repos.svc.Server.Pub.Encr)
+	for _, u := range []*User{forum, moderator, testAdmin(repos), server} {
+		if repos.moderated(forum, u) {
+			t.Error("moderated", u)
+		}
+		fn := repos.Join(forum.Join("a"))
+		_, err = testStore(repos, x, forum, u, "a", u.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, err := testContent(repos, fn); err != nil ||
+			s != u.String() {
+			t.Error("unlinked", u, s, err)
+		}
+	}
+	if !repos.moderated(forum, author) {
+		t.Fatal("unmoderated author")
+	}
+	pendingFN := repos.Join(forum.Join(AsnPending, "*"))
+	if _, err = testStore(repos, x, forum, author, "a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := repos.storage.Glob(pendingFN); len(l) != 1 {
+		t.Error("unqueued", l)
+	}
+	// directory blobs aren't staged
+	if _, err = testStore(repos, x, forum, author, "d/", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := repos.storage.Glob(pendingFN); len(l) != 1 {
+		t.Error("queued directory blob", l)
+	}
+	l, _ := repos.storage.Glob(repos.Join(forum.Join("d", "*")))
+	if len(l) != 1 {
+		t.Error("unlinked directory blob", l)
+	}
+}
@@ -182,7 +182,7 @@ func (pdu *PDU) Free() {
 		pdu.File = nil
 	}
 	if pdu.FN != "" {
-		if IsTmp(pdu.FN) || IsBridge(pdu.FN) {
+		if IsTmp(pdu.FN) {
 			os.Remove(pdu.FN)
 			pdu.Diag(debug.Depth(2), "file", pdu.FN, "removed")
 		}
@@ -0,0 +1,208 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/apptimistco/asn/debug/mutex"
+)
+
+const QuotaDefault = "default"
+
+// Quota limits the bytes and number of blobs authored by a user; zero is
+// unlimited.
+type Quota struct {
+	Bytes int64 `yaml:"bytes,omitempty"`
+	Blobs int   `yaml:"blobs,omitempty"`
+}
+
+// Quotas are keyed by user key, user type (e.g. "actual" or "forum") or
+// "default".
+type Quotas map[string]*Quota
+
+// Quota returns the most specific quota of the given user or nil if
+// unlimited.
+func (quotas Quotas) Quota(user *User) *Quota {
+	if q, ok := quotas[user.keystr]; ok {
+		return q
+	}
+	if q, ok := quotas[user.cache.UserType()]; ok {
+		return q
+	}
+	return quotas[QuotaDefault]
+}
+
+// QuotaUsage is the sum of bytes and number of blob files by an author.
+type QuotaUsage struct {
+	Bytes int64
+	Blobs int
+}
+
+// reposUsage maps author key strings to their usage. This is built from the
+// repos sum files on first use then charged as blobs are stored and refunded
+// as their sum files are removed; a nil map is rebuilt.
+type reposUsage struct {
+	mutex.Mutex
+	m map[string]*QuotaUsage
+}
+
+// CheckQuota returns ErrQuota if the author may not store another blob of the
+// given size. The admin and server have no quota.
+func (repos *Repos) CheckQuota(author *User, size int64) error {
+	repos.usage.Lock()
+	defer repos.usage.Unlock()
+	return repos.checkQuota(author, QuotaUsage{size, 1})
+}
+
+// checkQuota returns ErrQuota if the author may not add the given usage;
+// the caller must hold the usage lock.
+func (repos *Repos) checkQuota(author *User, more QuotaUsage) error {
+	if len(repos.quotas) == 0 || repos.IsService(author) {
+		return nil
+	}
+	q := repos.quotas.Quota(author)
+	if q == nil {
+		return nil
+	}
+	if err := repos.loadUsage(); err != nil {
+		return err
+	}
+	var u QuotaUsage
+	if p, ok := repos.usage.m[author.keystr]; ok {
+		u = *p
+	}
+	if (q.Bytes > 0 && u.Bytes+more.Bytes > q.Bytes) ||
+		(q.Blobs > 0 && u.Blobs+more.Blobs > q.Blobs) {
+		return ErrQuota
+	}
+	return nil
+}
+
+// DU writes the usage and quota of each user to w.
+func (repos *Repos) DU(w io.Writer, users ...*User) error {
+	limit := func(n int64) string {
+		if n == 0 {
+			return "unlimited"
+		}
+		return fmt.Sprint(n)
+	}
+	for _, user := range users {
+		u, err := repos.Usage(user)
+		if err != nil {
+			return err
+		}
+		q := repos.quotas.Quota(user)
+		if q == nil || repos.IsService(user) {
+			q = &Quota{}
+		}
+		fmt.Fprintf(w, "%s %d/%s bytes %d/%s blobs\n",
+			user.String(), u.Bytes, limit(q.Bytes),
+			u.Blobs, limit(int64(q.Blobs)))
+	}
+	return nil
+}
+
+// InvalidateUsage forces a rescan of the repos on the next quota check; use
+// this after renaming or otherwise changing sum files outside of Store and
+// Unlink.
+func (repos *Repos) InvalidateUsage() {
+	repos.usage.Lock()
+	repos.usage.m = nil
+	repos.usage.Unlock()
+}
+
+// IsService returns true if the user is the admin or server.
+func (repos *Repos) IsService(user *User) bool {
+	if repos.svc == nil {
+		return false
+	}
+	return bytes.Equal(user.key.Bytes(), repos.svc.Admin.Pub.Encr.Bytes()) ||
+		bytes.Equal(user.key.Bytes(), repos.svc.Server.Pub.Encr.Bytes())
+}
+
+// loadUsage builds the usage map, if necessary, from the header of each sum
+// file; the caller must hold the usage lock.
+func (repos *Repos) loadUsage() error {
+	if repos.usage.m != nil {
+		return nil
+	}
+	m := make(map[string]*QuotaUsage)
+	err := repos.storage.Filter(Time0, func(fn string) error {
+		fh, err := repos.ReadFileHeader(fn)
+		if err != nil {
+			return nil
+		}
+		fi, err := repos.storage.Stat(fn)
+		if err != nil {
+			return nil
+		}
+		keystr := fh.Blob.Author.FullString()
+		u, ok := m[keystr]
+		if !ok {
+			u = new(QuotaUsage)
+			m[keystr] = u
+		}
+		u.Bytes += fi.Size()
+		u.Blobs += 1
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	repos.usage.m = m
+	return nil
+}
+
+// release refunds the charge of a blob that wasn't stored or whose sum file
+// was removed.
+func (repos *Repos) release(keystr string, size int64) {
+	repos.usage.Lock()
+	defer repos.usage.Unlock()
+	if u, ok := repos.usage.m[keystr]; ok {
+		u.Bytes -= size
+		u.Blobs -= 1
+		if u.Blobs <= 0 {
+			delete(repos.usage.m, keystr)
+		}
+	}
+}
+
+// reserve charges the author for a blob of the given size before it's
+// stored so that concurrent stores can't exceed the quota; the caller must
+// release this if the blob isn't stored.
+func (repos *Repos) reserve(author *User, size int64) error {
+	repos.usage.Lock()
+	defer repos.usage.Unlock()
+	if err := repos.checkQuota(author, QuotaUsage{size, 1}); err != nil {
+		return err
+	}
+	if err := repos.loadUsage(); err != nil {
+		return err
+	}
+	u, ok := repos.usage.m[author.keystr]
+	if !ok {
+		u = new(QuotaUsage)
+		repos.usage.m[author.keystr] = u
+	}
+	u.Bytes += size
+	u.Blobs += 1
+	return nil
+}
+
+// Usage returns a copy of the given author's usage.
+func (repos *Repos) Usage(author *User) (QuotaUsage, error) {
+	repos.usage.Lock()
+	defer repos.usage.Unlock()
+	if err := repos.loadUsage(); err != nil {
+		return QuotaUsage{}, err
+	}
+	if u, ok := repos.usage.m[author.keystr]; ok {
+		return *u, nil
+	}
+	return QuotaUsage{}, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	repos.Set(Quotas{QuotaDefault: &Quota{Blobs: 2}})
+	x := new(testSender)
+	user := newTestUser(t, repos)
+	sum, err := testStore(repos, x, user, user, "a", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = testStore(repos, x, user, user, "b", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = testStore(repos, x, user, user, "c", "c"); err != ErrQuota {
+		t.Fatal("stored beyond quota:", err)
+	}
+	if u, _ := repos.Usage(user); u.Blobs != 2 {
+		t.Error("usage", u)
+	}
+	if err = repos.Unlink(repos.Join(sum.PN())); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := repos.Usage(user); u.Blobs != 1 {
+		t.Error("usage after unlink", u)
+	}
+	if _, err = testStore(repos, x, user, user, "c", "c"); err != nil {
+		t.Error("refund", err)
+	}
+	admin := testAdmin(repos)
+	for i := 0; i < 3; i++ {
+		_, err = testStore(repos, x, admin, admin, fmt.Sprint(i), "admin")
+		if err != nil {
+			t.Error("admin quota", err)
+		}
+	}
+}
+
+// testFailStorage fails every Store.
+type testFailStorage struct{ Storage }
+
+func (testFailStorage) Store(tmpfn, pn string) error { return os.ErrPermission }
+
+func TestQuotaRelease(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	user := newTestUser(t, repos)
+	if _, err := testStore(repos, x, user, user, "a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := repos.Usage(user)
+	if before.Blobs != 1 {
+		t.Error("usage", before)
+	}
+	st := repos.storage
+	repos.storage = testFailStorage{st}
+	if _, err := testStore(repos, x, user, user, "b", "b"); err == nil {
+		t.Error("stored to failed storage")
+	}
+	repos.storage = st
+	if u, _ := repos.Usage(user); u != before {
+		t.Error("charged for failed store", u, before)
+	}
+	// marks don't retain their sum file
+	if _, err := testStore(repos, x, user, user, AsnMark, ""); err != nil {
+		t.Error(err)
+	}
+	if u, _ := repos.Usage(user); u != before {
+		t.Error("charged for mark", u, before)
+	}
+}
+
+func TestQuotaConcurrent(t *testing.T) {
+	const max = 4
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	repos.Set(Quotas{QuotaDefault: &Quota{Blobs: max}})
+	x := new(testSender)
+	user := newTestUser(t, repos)
+	var (
+		wg     sync.WaitGroup
+		mutex  sync.Mutex
+		stored int
+	)
+	for i := 0; i < 4*max; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := testStore(repos, x, user, user,
+				fmt.Sprint("n", i), fmt.Sprint(i))
+			if err == nil {
+				mutex.Lock()
+				stored++
+				mutex.Unlock()
+			} else if err != ErrQuota {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if stored != max {
+		t.Error("stored", stored, "of", max)
+	}
+	if u, _ := repos.Usage(user); u.Blobs != max {
+		t.Error("usage", u)
+	}
+}
+
+func TestExecDU(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	user := newTestUser(t, repos)
+	other := newTestUser(t, repos)
+	ses := newTestSes(repos, user)
+	if _, ok := ses.ExecDU().(*bytes.Buffer); !ok {
+		t.Error("du of self failed")
+	}
+	if _, ok := ses.ExecDU(user.FullString()).(*bytes.Buffer); !ok {
+		t.Error("du of named self failed")
+	}
+	if v := ses.ExecDU(other.FullString()); v != os.ErrPermission {
+		t.Error("du of other", v)
+	}
+	ses = newTestSes(repos, testAdmin(repos))
+	if _, ok := ses.ExecDU(other.FullString()).(*bytes.Buffer); !ok {
+		t.Error("admin du of other failed")
+	}
+}
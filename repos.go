@@ -10,22 +10,19 @@ import (
 	"crypto/sha512"
 	"errors"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/apptimistco/asn/debug"
 	"github.com/apptimistco/asn/debug/file"
+	"github.com/apptimistco/asn/debug/mutex"
 )
 
 const (
-	ReposPS        = string(os.PathSeparator)
-	ReposTopSz     = 2
-	reposBridgeDN  = "bridge"
-	reposBridgePat = AsnStr + ReposPS + reposBridgeDN + ReposPS
+	ReposPS    = string(os.PathSeparator)
+	ReposTopSz = 2
 )
 
 var (
@@ -63,10 +60,24 @@ func ReadFromFile(rf ReadFromer, f *file.File) (err error) {
 
 type Repos struct {
 	debug.Debug
-	dn    string
-	tmp   Tmp
-	users Users
-	svc   *ServiceKeys
+	dn       string
+	tmp      Tmp
+	users    Users
+	svc      *ServiceKeys
+	storage  Storage
+	quotas   Quotas
+	usage    reposUsage
+	index    reposIndex
+	journal  reposJournal
+	uploads  reposUploads
+	inflight reposInflight
+	watches  reposWatches
+	bridged  reposBridged
+	cas      mutex.Mutex
+	retain   Retentions
+	gc       *GCConfig
+	history  *HistoryConfig
+	bridges  BridgeServers
 }
 
 func (repos *Repos) Approvals(x Sender, f *file.File, blob *Blob) error {
@@ -80,10 +91,10 @@ func (repos *Repos) Approvals(x Sender, f *file.File, blob *Blob) error {
 			id    Id
 			blob  Blob
 			owner *User
-			stat  syscall.Stat_t
+			nlink int
 		}
 	)
-	_, err := f.Seek(BlobNameOff+int64(len(blob.Name)), os.SEEK_SET)
+	_, err := BlobSeek(f)
 	if err != nil {
 		return err
 	}
@@ -96,45 +107,69 @@ func (repos *Repos) Approvals(x Sender, f *file.File, blob *Blob) error {
 			return err
 		}
 		t.fn = repos.Join(sum.PN())
-		if err = syscall.Stat(t.fn, &t.stat); err != nil {
+		if t.nlink, err = repos.storage.Nlink(t.fn); err != nil {
 			err = nil
 			continue
 		}
-		if t.f, err = file.Open(t.fn); err != nil {
+		if t.f, err = repos.Open(t.fn); err != nil {
 			return err
 		}
 		t.fi, _ = t.f.Stat()
 		t.v.ReadFrom(t.f)
 		t.id.ReadFrom(t.f)
 		t.blob.ReadFrom(t.f)
-		t.f.Close()
-		t.f = nil
 		t.owner = repos.users.User(&t.blob.Owner)
 		if t.owner == nil {
+			t.f.Close()
 			continue
 		}
-		if t.stat.Nlink > 1 {
+		// discount the queue link of a pending message
+		pending := repos.pending(&sum, &t.blob)
+		if pending != "" {
+			t.nlink--
+		}
+		if t.nlink > 1 {
+			t.f.Close()
 			repos.Diag(sum, "already linked")
 			continue
 		}
 		if !author.MayApproveFor(t.owner) {
+			t.f.Close()
 			repos.Diag(author.keystr[:8]+"...",
 				"may not approve for",
 				t.owner.keystr[:8]+"...")
 			continue
 		}
-		if t.blob.Name != "" &&
-			t.blob.Name != AsnMessages &&
-			t.blob.Name != AsnMessages+"/" {
-			repos.Diag("ignoring", t.blob.Name,
-				": you may only approve", AsnMessages)
-			continue
+		switch t.blob.Name {
+		case "", AsnMessages, AsnMessages + "/":
+			repos.lsm(x, &sum, t.fn, t.f, &t.blob)
+		default:
+			if pending == "" {
+				t.f.Close()
+				repos.Diag("ignoring", t.blob.Name, ": not pending")
+				continue
+			}
+			repos.approveNamed(x, &sum, t.fn, t.f, &t.blob)
+		}
+		t.f.Close()
+		if pending != "" {
+			repos.Unlink(pending)
 		}
-		repos.lsm(x, &sum, t.fn, t.f, &t.blob)
 	}
 	return nil
 }
 
+// BlobTime returns the header time of the named repos blob.
+func (repos *Repos) BlobTime(fn string) (t time.Time, err error) {
+	f, err := repos.Open(fn)
+	if err != nil {
+		return
+	}
+	t = BlobTime(f.File)
+	f.Close()
+	return
+}
+
 // DePrefix strips leading repos directory from pathname
 func (repos *Repos) DePrefix(pn string) string {
 	return pn[len(repos.dn)+1:]
@@ -150,71 +185,13 @@ func (repos *Repos) Expand(hex string, elements ...string) string {
 	return path
 }
 
-// Filter all REPOS/SHA files after epoch
-func (repos *Repos) Filter(epoch time.Time,
-	f func(fn string) error) (err error) {
-	var (
-		topdir, subdir *os.File
-		topfis, subfis []os.FileInfo
-	)
-	topdir, err = os.Open(repos.dn)
-	if err != nil {
-		return
+// Filter all REPOS/SHA files after epoch; those of a non-zero epoch are
+// found through the index in time order.
+func (repos *Repos) Filter(epoch time.Time, f func(fn string) error) error {
+	if epoch.IsZero() {
+		return repos.storage.Filter(epoch, f)
 	}
-	defer func() {
-		if err == io.EOF {
-			err = nil
-		}
-		topdir.Close()
-		subdir.Close()
-		topdir = nil
-		subdir = nil
-		topfis = nil
-		subfis = nil
-	}()
-topdirloop:
-	for {
-		topfis, err = topdir.Readdir(16)
-		if err != nil {
-			break topdirloop
-		}
-	topfiloop:
-		for _, topfi := range topfis {
-			if !IsTopDir(topfi) {
-				continue topfiloop
-			}
-			subfn := repos.Join(topfi.Name())
-			if subdir, err = os.Open(subfn); err != nil {
-				return
-			}
-		subdirloop:
-			for {
-				subfis, err = subdir.Readdir(16)
-				if err == io.EOF {
-					break subdirloop
-				}
-				if err != nil {
-					return
-				}
-			subfiloop:
-				for _, subfi := range subfis {
-					if !IsBlob(subfi) {
-						continue subfiloop
-					}
-					fn := repos.Join(topfi.Name(),
-						subfi.Name())
-					if epoch.IsZero() ||
-						BlobTime(fn).After(epoch) {
-						if err = f(fn); err != nil {
-							return
-						}
-					}
-				}
-			}
-		}
-		topfis, err = topdir.Readdir(16)
-	}
-	return
+	return repos.IndexFilter(epoch, f)
 }
 
 func (repos Repos) FN2Ref(slogin, fn string) string {
@@ -244,7 +221,7 @@ func (repos Repos) FN2Ref(slogin, fn string) string {
 }
 
 func (repos *Repos) Glob(user, glob string) (m []string, err error) {
-	fm, err := filepath.Glob(repos.Expand(user, glob))
+	fm, err := repos.storage.Glob(repos.Expand(user, glob))
 	if err == nil {
 		m = append(m, fm...)
 		fm = nil
@@ -252,43 +229,68 @@ func (repos *Repos) Glob(user, glob string) (m []string, err error) {
 	return
 }
 
+// isLinked returns true if the stored blob is its owner's linked version of
+// its name rather than one that's staged or superseded.
+func (repos *Repos) isLinked(sum *Sum, blob *Blob) bool {
+	if !indexLinked(blob.Name) {
+		return false
+	}
+	owner := repos.users.User(&blob.Owner)
+	if owner == nil {
+		return false
+	}
+	t, err := repos.BlobTime(repos.Join(owner.Join(blob.Name)))
+	return err == nil && t.Equal(blob.Time) && repos.pending(sum, blob) == ""
+}
+
+// IsSumFile returns true if fn is a REPOS/SUM[:2]/SUM[2:] pathname.
+func (repos *Repos) IsSumFile(fn string) bool {
+	if !strings.HasPrefix(fn, repos.dn+ReposPS) {
+		return false
+	}
+	dn, sfn := filepath.Split(repos.DePrefix(fn))
+	return len(dn) == ReposTopSz+1 && len(sfn) == 2*(SumSz-1) &&
+		IsHex(sfn)
+}
+
 func (repos *Repos) Join(elements ...string) string {
 	return repos.dn + ReposPS + filepath.Join(elements...)
 }
 
+// LN links dst to the blob of src through the storage backend; this will
+// panic on error so the calling function must recover.
+func (repos *Repos) LN(src, dst string) {
+	repos.unindexLink(dst)
+	if err := repos.storage.Link(src, dst); err != nil {
+		panic(err)
+	}
+	repos.journal.append(JournalLink, repos.DePrefix(src),
+		repos.DePrefix(dst))
+}
+
+// LoadUsers registers the repos users; their caches are loaded on lookup.
 func (repos *Repos) LoadUsers() error {
-	var (
-		topdir []os.FileInfo
-		subdir []os.FileInfo
-		err    error
-	)
-	defer func() {
-		topdir = nil
-		subdir = nil
-	}()
-	if topdir, err = ioutil.ReadDir(repos.dn); err != nil {
-		return &Error{repos.dn, err.Error()}
-	}
-	for _, fi := range topdir {
-		if fi.IsDir() && len(fi.Name()) == ReposTopSz {
-			subdn := repos.Join(fi.Name())
-			if subdir, err = ioutil.ReadDir(subdn); err != nil {
-				return &Error{subdn, err.Error()}
-			}
-			for _, sub := range subdir {
-				if sub.IsDir() && IsUser(sub.Name()) {
-					suser := fi.Name() + sub.Name()
-					user := repos.users.NewUserString(suser)
-					err = user.cache.Load(repos.Join(user.DN()))
-					if err != nil {
-						return err
-					}
-				}
-			}
-			subdir = nil
-		}
-	}
-	return nil
+	repos.users.Set(func(user *User) error {
+		return user.cache.Load(repos.storage, repos.Join(user.DN()))
+	})
+	return repos.storage.Users(func(keystr string) error {
+		repos.users.Register(keystr)
+		return nil
+	})
+}
+
+// reloadCache loads the user's cache from storage then replaces its entries
+// in place under the users lock for those that have it.
+func (repos *Repos) reloadCache(user *User) {
+	c := newCache(&user.key)
+	if err := c.Load(repos.storage, repos.Join(user.DN())); err != nil {
+		repos.Diag(err)
+	}
+	repos.users.Lock()
+	for kw, e := range c {
+		*user.cache[kw] = *e
+	}
+	repos.users.Unlock()
 }
 
 // lsm - Link and Send Message
@@ -297,19 +299,17 @@ func (repos *Repos) lsm(x Sender, sum *Sum, fn string, f *file.File,
 	owner := repos.users.User(&blob.Owner)
 	author := repos.users.User(&blob.Author)
 	x.Send(&owner.key, f)
-	LN(fn, repos.Join(owner.Join(AsnMessages, blob.FN(sum))))
+	repos.LN(fn, repos.Join(owner.Join(AsnMessages, blob.FN(sum))))
 	if author != owner {
 		x.Send(&author.key, f)
-		LN(fn, repos.Join(author.Join(AsnMessages, blob.FN(sum))))
-	}
-	if subscribers := owner.cache.Subscribers(); len(*subscribers) > 0 {
-		for _, k := range *subscribers {
-			sub := repos.users.User(&k)
-			if sub != nil && sub != owner && sub != author {
-				x.Send(&k, f)
-				LN(fn, repos.Join(sub.Join(AsnMessages,
-					blob.FN(sum))))
-			}
+		repos.LN(fn, repos.Join(author.Join(AsnMessages, blob.FN(sum))))
+	}
+	for _, k := range owner.cache.Subscribers().Keys() {
+		sub := repos.users.User(&k)
+		if sub != nil && sub != owner && sub != author {
+			x.Send(&k, f)
+			repos.LN(fn, repos.Join(sub.Join(AsnMessages,
+				blob.FN(sum))))
 		}
 	}
 }
@@ -330,7 +330,7 @@ func (repos *Repos) Open(fn string) (*file.File, error) {
 	if !strings.HasPrefix(fn, repos.dn) {
 		fn = repos.Join(fn)
 	}
-	return file.Open(fn)
+	return repos.storage.Open(fn)
 }
 
 func (repos *Repos) ParsePath(xn string) (user *User, fn string) {
@@ -360,6 +360,9 @@ func (repos *Repos) ParsePath(xn string) (user *User, fn string) {
 }
 
 func (repos *Repos) Permission(owner, author *User, name string) error {
+	if name == AsnBridge || name == AsnBridge+"/" {
+		return repos.BridgePermission(owner, author)
+	}
 	if bytes.Equal(author.key.Bytes(), repos.svc.Admin.Pub.Encr.Bytes()) {
 		return nil
 	}
@@ -376,6 +379,36 @@ func (repos *Repos) Permission(owner, author *User, name string) error {
 	return os.ErrPermission
 }
 
+// ReadFileHeader of the named repos blob.
+func (repos *Repos) ReadFileHeader(fn string) (fh *FH, err error) {
+	f, err := repos.Open(fn)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fh = new(FH)
+	if _, err = fh.ReadFrom(f); err != nil {
+		fh = nil
+	}
+	return
+}
+
+// MayRemove returns true if the author may remove the owner's named blob;
+// i.e. it's the admin, server or an editor, or it's removing its own key
+// from the owner's subscribers or invites.
+func (repos *Repos) MayRemove(owner, author *User, name string) bool {
+	if bytes.Equal(author.key.Bytes(), repos.svc.Admin.Pub.Encr.Bytes()) ||
+		bytes.Equal(author.key.Bytes(), repos.svc.Server.Pub.Encr.Bytes()) ||
+		author.MayEdit(owner) {
+		return true
+	}
+	switch ln, key := listKey(name); ln {
+	case AsnSubscribers, AsnInvites:
+		return *key == author.key
+	}
+	return false
+}
+
 func (repos *Repos) RemovalPermission(f *file.File, blob *Blob) error {
 	author := repos.users.User(&blob.Author)
 	if bytes.Equal(author.key.Bytes(), repos.svc.Admin.Pub.Encr.Bytes()) {
@@ -384,7 +417,7 @@ func (repos *Repos) RemovalPermission(f *file.File, blob *Blob) error {
 	if bytes.Equal(author.key.Bytes(), repos.svc.Server.Pub.Encr.Bytes()) {
 		return nil
 	}
-	_, err := f.Seek(BlobNameOff+int64(len(blob.Name)), os.SEEK_SET)
+	_, err := BlobSeek(f)
 	if err != nil {
 		return err
 	}
@@ -410,7 +443,8 @@ scan:
 		if user == nil {
 			return &Error{keystr, "no such user"}
 		}
-		if author.MayEdit(user) {
+		name := filepath.ToSlash(fn[3+i+1:])
+		if repos.MayRemove(user, author, name) {
 			continue scan
 		}
 		return os.ErrPermission
@@ -419,69 +453,133 @@ scan:
 }
 
 func (repos *Repos) Removals(f *file.File, blob *Blob) error {
-	_, err := f.Seek(BlobNameOff+int64(len(blob.Name)), os.SEEK_SET)
+	_, err := BlobSeek(f)
 	if err != nil {
 		return err
 	}
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		fn := repos.Join(scanner.Text())
-		if _, err := os.Stat(fn); err == nil {
-			if err = syscall.Unlink(fn); err != nil {
-				repos.Diag(err)
-				return err
-			}
+		if err := repos.Unlink(fn); err == nil {
 			repos.Diag("unlinked", fn)
+			repos.unlist(fn)
+		} else if !os.IsNotExist(err) {
+			repos.Diag(err)
+			return err
 		}
 	}
 	return nil
 }
 
+// listKey returns the list and key of an asn/LIST/KEY name, if it is one.
+func listKey(name string) (string, *PubEncr) {
+	for _, ln := range AsnPubEncrLists {
+		if strings.HasPrefix(name, ln+"/") {
+			key, err := NewPubEncr(name[len(ln)+1:])
+			if err == nil {
+				return ln, key
+			}
+		}
+	}
+	return "", nil
+}
+
+// unlist removes the key of an unlinked OWNER/asn/LIST/KEY, or all of those
+// of an unlinked OWNER/asn/LIST, from the owner's cache.
+func (repos *Repos) unlist(fn string) {
+	owner, name := repos.ParsePath(fn)
+	if owner == nil {
+		return
+	}
+	name = filepath.ToSlash(name)
+	for _, ln := range AsnPubEncrLists {
+		if name == ln {
+			repos.users.Lock()
+			owner.cache.PubEncrList(ln).Reset()
+			repos.users.Unlock()
+			return
+		}
+	}
+	if ln, key := listKey(name); ln != "" {
+		repos.users.Lock()
+		owner.cache.PubEncrList(ln).KeyDel(key)
+		repos.users.Unlock()
+	}
+}
+
 func (repos *Repos) Reset() {
 	repos.tmp.Reset()
+	if mem, ok := repos.storage.(*MemStorage); ok {
+		mem.Reset()
+	}
 	repos.users.Reset()
 	repos.dn = ""
 	repos.svc = nil
+	repos.storage = nil
+	repos.quotas = nil
+	repos.retain = nil
+	repos.gc = nil
+	repos.history = nil
+	repos.bridges = nil
+	repos.InvalidateUsage()
+	repos.index.Lock()
+	repos.index.reset()
+	repos.index.Unlock()
+	repos.journal.Lock()
+	repos.journal.reset()
+	repos.journal.Unlock()
+	repos.uploads.Lock()
+	repos.uploads.dn = ""
+	repos.uploads.Unlock()
+	repos.inflight.Lock()
+	repos.inflight.m = nil
+	repos.inflight.Unlock()
+	repos.watches.Lock()
+	repos.watches.m = nil
+	repos.watches.Unlock()
+	repos.bridged.Lock()
+	repos.bridged.m = nil
+	repos.bridged.Unlock()
 }
 
-// Search the repos for the unique longest matching blob file.
-func (repos *Repos) Search(x string) (match string, err error) {
-	topdn := x[:ReposTopSz]
-	subdfn := x[ReposTopSz:]
-	lensubdfn := len(subdfn)
-	topf, err := repos.Open(topdn)
+// Search the repos for the unique longest matching blob file through the
+// index, resorting to the storage backend if it has no match or its match
+// has gone.
+func (repos *Repos) Search(x string) (string, error) {
+	match, err := repos.SearchIndex(x)
 	if err != nil {
-		return
+		return match, err
 	}
-	defer topf.Close()
-	for {
-		var names []string
-		names, err = topf.Readdirnames(16)
-		if len(names) > 0 {
-			for _, name := range names {
-				if len(name) >= lensubdfn &&
-					name[:lensubdfn] == subdfn {
-					if match != "" {
-						match = ""
-						err = ErrAmbiguos
-						return
-					}
-					match = repos.Join(topdn, name)
-				}
-			}
-		} else {
-			if err == io.EOF {
-				err = nil
-			}
-			return
+	if match != "" {
+		if _, err = repos.storage.Stat(match); err == nil {
+			return match, nil
 		}
 	}
+	if len(x) <= ReposTopSz {
+		return "", nil
+	}
+	match, err = repos.storage.Search(strings.ToLower(x))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return match, err
 }
 
 func (repos *Repos) Set(v interface{}) error {
 	switch t := v.(type) {
 	case string:
-		if err := repos.tmp.Set(t); err != nil {
+		if repos.storage == nil {
+			repos.storage = NewFSStorage(t)
+		}
+		tmpdn := t
+		if mem, ok := repos.storage.(*MemStorage); ok {
+			tmpdn = mem.TmpDir()
+		}
+		if err := repos.tmp.Set(tmpdn); err != nil {
+			return err
+		}
+		if err := repos.LoadUploads(tmpdn); err != nil {
+			repos.tmp.Reset()
 			return err
 		}
 		repos.dn = t
@@ -492,6 +590,28 @@ func (repos *Repos) Set(v interface{}) error {
 			repos.tmp.Reset()
 			return err
 		}
+		if err := repos.LoadIndex(); err != nil {
+			repos.dn = ""
+			repos.tmp.Reset()
+			return err
+		}
+		if err := repos.LoadJournal(); err != nil {
+			repos.dn = ""
+			repos.tmp.Reset()
+			return err
+		}
+	case Storage:
+		repos.storage = t
+	case Quotas:
+		repos.quotas = t
+	case Retentions:
+		repos.retain = t
+	case *GCConfig:
+		repos.gc = t
+	case *HistoryConfig:
+		repos.history = t
+	case BridgeServers:
+		repos.bridges = t
 	case *ServiceKeys:
 		repos.svc = t
 	default:
@@ -548,14 +668,119 @@ func (repos *Repos) Store(x Sender, v Version, blob *Blob,
 	sum = new(Sum)
 	copy(sum[:], h.Sum([]byte{}))
 	sumFN := repos.Join(sum.PN())
-	if _, xerr := os.Stat(sumFN); os.IsNotExist(xerr) {
-		LN(f.Name(), sumFN)
-	} else {
-		err = os.ErrExist
+	// keep the owner resident while its cache may change
+	owner := repos.users.Hold(repos.User(&blob.Owner))
+	defer repos.users.Release(owner)
+	author := repos.User(&blob.Author)
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if err = repos.reserve(author, fi.Size()); err != nil {
+		return
+	}
+	repos.storing(sumFN, false)
+	defer repos.storing(sumFN, true)
+	if _, ok := x.(txnSender); !ok {
+		// the transaction's own store is the unit of recovery
+		repos.journal.append(JournalStore, sum.FullString())
+		defer repos.journal.append(JournalDone, sum.FullString())
+	}
+	if err = repos.storage.Store(f.Name(), sumFN); err != nil {
+		repos.release(author.keystr, fi.Size())
 		return
 	}
+	defer func() {
+		_, xerr := repos.storage.Stat(sumFN)
+		retained := xerr == nil
+		if err == nil {
+			repos.Index(sum, blob, retained,
+				repos.isLinked(sum, blob))
+			repos.watched(x, sum, blob, f)
+		}
+	}()
+	err = repos.dispatch(x, sum, sumFN, f, blob)
+	return
+}
+
+// StoreIfSumMin is the least number of digits of a StoreIf sum abbreviation.
+const StoreIfSumMin = 16
+
+// casSender is that of a caller holding the repos.cas lock.
+type casSender struct {
+	Sender
+}
+
+// casHeld returns true if the sender's caller holds the repos.cas lock.
+func casHeld(x Sender) bool {
+	switch x.(type) {
+	case casSender, txnSender:
+		return true
+	}
+	return false
+}
+
+// StoreIf stores the blob only if its owner has no link of the same name,
+// with an empty cur sum string, or the linked version has that sum or
+// abbreviation of at least StoreIfSumMin digits and isn't newer; otherwise,
+// it returns ErrConflict. These conditional stores are serialized with the
+// linking of other stores. Blobs that would be staged for moderation can't
+// be conditional as the condition may not hold once they're approved.
+func (repos *Repos) StoreIf(x Sender, cur string, v Version, blob *Blob,
+	wts ...WriteToer) (*Sum, error) {
+	if !indexLinked(blob.Name) {
+		return nil, &Error{blob.Name, "derived name can't be conditional"}
+	}
+	if cur != "" && (len(cur) < StoreIfSumMin || len(cur) > 2*SumSz ||
+		!IsHex(cur)) {
+		return nil, &Error{cur, "invalid sum abbreviation"}
+	}
+	owner := repos.User(&blob.Owner)
+	author := repos.User(&blob.Author)
+	if !strings.HasPrefix(blob.Name, "asn/") &&
+		repos.moderated(owner, author) {
+		return nil, &Error{blob.Name, "moderated blob can't be conditional"}
+	}
+	repos.cas.Lock()
+	defer repos.cas.Unlock()
+	x = casSender{x}
+	fn := repos.Join(owner.Join(blob.Name))
+	if _, err := repos.storage.Stat(fn); err != nil {
+		if cur != "" {
+			return nil, ErrConflict
+		}
+		return repos.Store(x, v, blob, wts...)
+	} else if cur == "" {
+		return nil, ErrConflict
+	}
+	f, err := repos.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	s := NewSumOf(f).FullString()
+	f.Close()
+	if !strings.HasPrefix(s, strings.ToLower(cur)) {
+		return nil, ErrConflict
+	}
+	if t, err := repos.LinkTime(fn); err != nil {
+		return nil, err
+	} else if t.After(blob.Time) {
+		return nil, ErrConflict
+	}
+	return repos.Store(x, v, blob, wts...)
+}
+
+// dispatch links and forwards a stored sum file by its blob name; this will
+// panic on link error so the calling function must recover. Named links are
+// serialized with conditional stores.
+func (repos *Repos) dispatch(x Sender, sum *Sum, sumFN string, f *file.File,
+	blob *Blob) (err error) {
 	owner := repos.User(&blob.Owner)
 	author := repos.User(&blob.Author)
+	if indexLinked(blob.Name) && !casHeld(x) {
+		repos.cas.Lock()
+		defer repos.cas.Unlock()
+	}
 	for _, fn := range AsnPubEncrLists {
 		if strings.HasPrefix(blob.Name, fn+"/") {
 			var key *PubEncr
@@ -568,7 +793,7 @@ func (repos *Repos) Store(x Sender, v Version, blob *Blob,
 			owner.cache.PubEncrList(fn).KeyAdd(key)
 			repos.users.Unlock()
 			x.Send(Mirrors, f)
-			LN(sumFN, repos.Join(owner.Join(blob.Name)))
+			repos.LN(sumFN, repos.Join(owner.Join(blob.Name)))
 			return
 		} else if blob.Name == fn {
 			err = ReadFromFile(owner.cache.PubEncrList(fn), f)
@@ -576,7 +801,7 @@ func (repos *Repos) Store(x Sender, v Version, blob *Blob,
 				return
 			}
 			x.Send(Mirrors, f)
-			LN(sumFN, repos.Join(owner.Join(blob.Name)))
+			repos.LN(sumFN, repos.Join(owner.Join(blob.Name)))
 			return
 		}
 	}
@@ -589,78 +814,138 @@ func (repos *Repos) Store(x Sender, v Version, blob *Blob,
 			}
 			err = nil
 		}
-		LN(sumFN, repos.Join(owner.Join(blob.Name)))
+		repos.LN(sumFN, repos.Join(owner.Join(blob.Name)))
 		repos.users.ForEachLoggedInUser(func(u *User) error {
-			if u != owner {
+			if u != owner && repos.MarkVisible(owner, u) {
 				x.Send(&u.key, f)
 			}
 			return nil
 		})
 		// don't retain sum link as there is no need to recover a mark
-		syscall.Unlink(sumFN)
+		repos.Unlink(sumFN)
 	case blob.Name == AsnAuth:
 		err = ReadFromFile(owner.cache.PubAuth(blob.Name), f)
 		if err == nil {
 			x.Send(Mirrors, f)
-			LN(sumFN, repos.Join(owner.Join(blob.Name)))
+			repos.LN(sumFN, repos.Join(owner.Join(blob.Name)))
 		}
 	case blob.Name == AsnAuthor:
 		err = ReadFromFile(owner.cache.PubEncr(blob.Name), f)
 		if err == nil {
 			x.Send(Mirrors, f)
-			LN(sumFN, repos.Join(owner.Join(blob.Name)))
+			repos.LN(sumFN, repos.Join(owner.Join(blob.Name)))
 		}
 	case blob.Name == AsnBridge, blob.Name == AsnBridge+"/":
-		// don't link, just send to all invites
-		for _, k := range *(owner.cache.Invites()) {
-			x.Send(&k, f)
+		// don't link, just send to signed-in invitees
+		repos.Bridge(x, sum, owner, f)
+		repos.Unlink(sumFN)
+	case blob.Name == AsnVisibility:
+		v := NewCacheBuffer()
+		if err = ReadFromFile(v, f); err != nil {
+			return
+		}
+		if s := strings.TrimSpace(v.String()); !IsVisibility(s) {
+			repos.Unlink(sumFN)
+			err = &Error{s, "invalid visibility"}
+			return
 		}
-		syscall.Unlink(sumFN)
-	case blob.Name == AsnID:
+		repos.users.Lock()
+		owner.cache[blob.Name].Cacher = v
+		repos.users.Unlock()
+		x.Send(Mirrors, f)
+		repos.LN(sumFN, repos.Join(owner.Join(blob.Name)))
+	case blob.Name == AsnID, blob.Name == AsnUser:
 		id := owner.cache.CacheBuffer(blob.Name)
 		id.Reset()
 		err = ReadFromFile(id, f)
 		if err == nil {
 			x.Send(Mirrors, f)
-			LN(sumFN, repos.Join(owner.Join(blob.Name)))
+			repos.LN(sumFN, repos.Join(owner.Join(blob.Name)))
 		}
 	case blob.Name == "", blob.Name == AsnMessages,
 		blob.Name == AsnMessages+"/":
 		x.Send(Mirrors, f)
-		moderators := owner.cache.Moderators()
-		if len(*moderators) > 0 && !author.MayApproveFor(owner) {
-			for _, k := range *moderators {
-				x.Send(&k, f)
-			}
+		if repos.moderated(owner, author) {
+			repos.pend(x, sum, sumFN, f, blob)
 		} else {
 			repos.lsm(x, sum, sumFN, f, blob)
 		}
+	case blob.Name == AsnApprovals, blob.Name == AsnApprovals+"/":
+		if err = repos.Approvals(x, f, blob); err == nil {
+			x.Send(Mirrors, f)
+		}
+	case blob.Name == AsnRejections, blob.Name == AsnRejections+"/":
+		if err = repos.Rejections(x, sum, sumFN, f, blob); err == nil {
+			x.Send(Mirrors, f)
+		}
+	case blob.Name == AsnHistory,
+		strings.HasPrefix(blob.Name, AsnHistory+"/"),
+		blob.Name == AsnPending,
+		strings.HasPrefix(blob.Name, AsnPending+"/"):
+		repos.Unlink(sumFN)
+		err = &Error{blob.Name, "reserved"}
 	case strings.HasSuffix(blob.Name, "/"):
 		x.Send(Mirrors, f)
-		LN(sumFN, repos.Join(owner.Join(blob.Name, blob.FN(sum))))
-	case blob.Name == AsnApprovals:
-		if err = repos.Approvals(x, f, blob); err == nil {
+		repos.LN(sumFN, repos.Join(owner.Join(blob.Name,
+			blob.FN(sum))))
+	case blob.Name == AsnTransaction:
+		// don't retain sum link as its blobs are
+		if err = repos.Transaction(x, f, blob); err == nil {
 			x.Send(Mirrors, f)
 		}
+		repos.Unlink(sumFN)
 	case blob.Name == AsnRemovals:
 		if err = repos.RemovalPermission(f, blob); err == nil {
 			x.Send(Mirrors, f)
 			err = repos.Removals(f, blob)
 		}
 	default:
+		if !strings.HasPrefix(blob.Name, "asn/") &&
+			repos.moderated(owner, author) {
+			// stage until approved
+			x.Send(Mirrors, f)
+			repos.pend(x, sum, sumFN, f, blob)
+			return
+		}
 		fn := repos.Join(owner.Join(blob.Name))
-		if _, xerr := os.Stat(fn); xerr == nil {
-			if BlobTime(fn).After(blob.Time) {
-				return // don't link or mirror older blob
+		if t, xerr := repos.BlobTime(fn); xerr == nil {
+			if t.After(blob.Time) {
+				// don't link or mirror older blob
+				repos.historyLN(sumFN, owner, blob, sum)
+				return
 			}
-			syscall.Unlink(fn)
+			repos.Unlink(fn)
 		}
 		x.Send(Mirrors, f)
-		LN(sumFN, fn)
+		repos.LN(sumFN, fn)
+		repos.historyLN(sumFN, owner, blob, sum)
 	}
 	return
 }
 
+// Unlink removes the sum file or link through the storage backend, recording
+// the removal in the journal and index; the author of a removed sum file is
+// refunded its size.
+func (repos *Repos) Unlink(fn string) error {
+	var (
+		fh *FH
+		fi os.FileInfo
+	)
+	if repos.IsSumFile(fn) {
+		fh, _ = repos.ReadFileHeader(fn)
+		fi, _ = repos.storage.Stat(fn)
+	}
+	if err := repos.storage.Unlink(fn); err != nil {
+		return err
+	}
+	repos.journal.append(JournalUnlink, repos.DePrefix(fn))
+	repos.Unindex(fn)
+	if fh != nil && fi != nil {
+		repos.release(fh.Blob.Author.FullString(), fi.Size())
+	}
+	return nil
+}
+
 // UnsafeNewUser will panic on error so the calling function must recover.
 func (repos *Repos) UnsafeNewUser(v interface{}) (user *User) {
 	switch t := v.(type) {
@@ -671,12 +956,9 @@ func (repos *Repos) UnsafeNewUser(v interface{}) (user *User) {
 	default:
 		panic(os.ErrInvalid)
 	}
-	dn := repos.Join(user.dn)
-	if _, err := os.Stat(dn); err != nil {
-		if err = MkdirAll(dn); err != nil {
-			user = nil
-			panic(err)
-		}
+	if err := repos.storage.Mkdir(repos.Join(user.dn)); err != nil {
+		user = nil
+		panic(err)
 	}
 	return user
 }
@@ -0,0 +1,320 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/apptimistco/asn/debug/file"
+	"github.com/apptimistco/asn/debug/mutex"
+)
+
+// testSender records the keys of each Send.
+type testSender struct {
+	mutex.Mutex
+	sent []PubEncr
+}
+
+func (x *testSender) Send(k *PubEncr, f *file.File) {
+	x.Lock()
+	defer x.Unlock()
+	x.sent = append(x.sent, *k)
+}
+
+// Sent returns the number of sends to the given key.
+func (x *testSender) Sent(k *PubEncr) (n int) {
+	x.Lock()
+	defer x.Unlock()
+	for _, s := range x.sent {
+		if s == *k {
+			n++
+		}
+	}
+	return
+}
+
+func (x *testSender) Reset() {
+	x.Lock()
+	defer x.Unlock()
+	x.sent = nil
+}
+
+// newTestRepos returns a repos of the named storage backend in a new
+// temporary directory with random service keys; freeTestRepos removes it.
+func newTestRepos(t *testing.T, storage string) *Repos {
+	dn, err := ioutil.TempDir("", "asn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos := new(Repos)
+	st, err := NewStorage(storage, dn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = repos.Set(st); err != nil {
+		t.Fatal(err)
+	}
+	if err = repos.Set(dn); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewRandomServiceKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos.Set(keys)
+	for _, k := range []*UserKeys{keys.Admin, keys.Server} {
+		user, err := repos.NewUser(k.Pub.Encr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.pinned = true
+	}
+	return repos
+}
+
+func freeTestRepos(repos *Repos) {
+	dn := repos.dn
+	repos.Reset()
+	os.RemoveAll(dn)
+}
+
+// newTestUser returns a new repos user with a random key.
+func newTestUser(t *testing.T, repos *Repos) *User {
+	k, _, err := NewRandomEncrKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := repos.NewUser(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// testStore stores a blob of the given name and content by the author.
+func testStore(repos *Repos, x Sender, owner, author *User, name,
+	content string) (*Sum, error) {
+	return testStoreAt(repos, x, owner, author, name, content, time.Now())
+}
+
+func testStoreAt(repos *Repos, x Sender, owner, author *User, name,
+	content string, t time.Time) (*Sum, error) {
+	blob := NewBlobWith(&owner.key, &author.key, name, t)
+	defer blob.Free()
+	return repos.Store(x, Latest, blob, bytes.NewBufferString(content))
+}
+
+// testContent returns the content of the named repos file after its header.
+func testContent(repos *Repos, fn string) (string, error) {
+	f, err := repos.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = BlobSeek(f); err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(f)
+	return string(b), err
+}
+
+func TestReposStore(t *testing.T) {
+	for _, st := range []string{"fs", "mem"} {
+		repos := newTestRepos(t, st)
+		x := new(testSender)
+		owner := newTestUser(t, repos)
+		sum, err := testStore(repos, x, owner, owner, "hello", "hello world")
+		if err != nil {
+			t.Fatal(st, err)
+		}
+		s, err := testContent(repos, repos.Join(owner.Join("hello")))
+		if err != nil || s != "hello world" {
+			t.Error(st, "hello:", s, err)
+		}
+		if fn, err := repos.Search(sum.FullString()[:16]); err != nil ||
+			fn != repos.Join(sum.PN()) {
+			t.Error(st, "search:", fn, err)
+		}
+		if _, err = repos.Open(repos.Join(owner.Join("nosuch"))); err == nil {
+			t.Error(st, "opened nosuch")
+		}
+		freeTestRepos(repos)
+	}
+}
+
+// newTestSes returns a session of the repos signed-in as the given user.
+func newTestSes(repos *Repos, user *User) *Ses {
+	ses := new(Ses)
+	ses.Set(&Config{Name: "test", Keys: repos.svc})
+	ses.Set(repos)
+	ses.Set(func(func(*Ses)) {})
+	ses.user = user
+	ses.Keys.Client.Login = user.key
+	return ses
+}
+
+// testAdmin returns the repos admin user.
+func testAdmin(repos *Repos) *User {
+	return repos.users.User(repos.svc.Admin.Pub.Encr)
+}
+
+func TestReposSearch(t *testing.T) {
+	for _, st := range []string{"fs", "mem"} {
+		repos := newTestRepos(t, st)
+		x := new(testSender)
+		owner := newTestUser(t, repos)
+		sum, err := testStore(repos, x, owner, owner, "a", "a")
+		if err != nil {
+			t.Fatal(st, err)
+		}
+		fn := repos.Join(sum.PN())
+		// an index miss resorts to storage
+		repos.Unindex(fn)
+		if match, err := repos.Search(sum.FullString()[:16]); err != nil ||
+			match != fn {
+			t.Error(st, "unindexed:", match, err)
+		}
+		// as does a match that has gone
+		repos.storage.Unlink(fn)
+		if match, err := repos.Search(sum.FullString()[:16]); err != nil ||
+			match != "" {
+			t.Error(st, "gone:", match, err)
+		}
+		for _, s := range []string{"0", "ffffffffffffffff"} {
+			if match, err := repos.Search(s); err != nil || match != "" {
+				t.Error(st, "nosuch", s, match, err)
+			}
+		}
+		freeTestRepos(repos)
+	}
+}
+
+// testAck returns the content, after the header, of a session exec's
+// acknowledgment or its error.
+func testAck(t *testing.T, ses *Ses, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case *PDU:
+		defer v.Free()
+		var req Req
+		hdr, err := ses.asn.NewAckSuccessPDUFile(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := hdr.Size()
+		hdr.Free()
+		if err = v.Open(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b[n:]), nil
+	case error:
+		return "", v
+	default:
+		t.Fatal("ack", v)
+	}
+	return "", nil
+}
+
+func testStoreIf(repos *Repos, x Sender, owner, author *User, cur, name,
+	content string) (*Sum, error) {
+	blob := NewBlobWith(&owner.key, &author.key, name, time.Now())
+	defer blob.Free()
+	return repos.StoreIf(x, cur, Latest, blob, bytes.NewBufferString(content))
+}
+
+func TestStoreIf(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	sum, err := testStoreIf(repos, x, owner, owner, "", "a", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = testStoreIf(repos, x, owner, owner, "", "a", "2"); err !=
+		ErrConflict {
+		t.Error("replaced with absent condition", err)
+	}
+	s := sum.FullString()
+	if _, err = testStoreIf(repos, x, owner, owner, s[:StoreIfSumMin-1],
+		"a", "2"); err == nil || err == ErrConflict {
+		t.Error("short abbreviation", err)
+	}
+	if _, err = testStoreIf(repos, x, owner, owner, s, "a/", "2"); err ==
+		nil {
+		t.Error("conditional derived name")
+	}
+	if _, err = testStoreIf(repos, x, owner, owner, s[:StoreIfSumMin],
+		"a", "2"); err != nil {
+		t.Error(err)
+	}
+	if _, err = testStoreIf(repos, x, owner, owner, s, "a", "3"); err !=
+		ErrConflict {
+		t.Error("replaced with stale sum", err)
+	}
+	// moderated blobs can't be conditional
+	author := newTestUser(t, repos)
+	moderator := newTestUser(t, repos)
+	for _, name := range []string{
+		AsnEditors + "/" + author.FullString(),
+		AsnModerators + "/" + moderator.FullString(),
+	} {
+		if _, err = testStore(repos, x, owner, owner, name, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = testStoreIf(repos, x, owner, author, "", "b", "1"); err ==
+		nil {
+		t.Error("staged conditional blob")
+	}
+	if l, _ := repos.Pending("", owner); len(l) != 0 {
+		t.Error("pending", len(l))
+	}
+}
+
+func TestStoreIfSerialized(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	// plain stores of named blobs wait for conditional stores
+	repos.cas.Lock()
+	done := make(chan error)
+	go func() {
+		_, err := testStore(repos, x, owner, owner, "a", "1")
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Error("stored during conditional store")
+	case <-time.After(50 * time.Millisecond):
+	}
+	repos.cas.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// messages don't
+	repos.cas.Lock()
+	go func() {
+		_, err := testStore(repos, x, owner, owner, "", "1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("message waited for conditional store")
+	}
+	repos.cas.Unlock()
+}
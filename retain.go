@@ -0,0 +1,200 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const RetainInterval = time.Hour
+
+// Retention removes an owner's blobs that match Name and are either older
+// than Age or beyond the latest Keep. Type, if set, limits the rule to owners
+// of that type (e.g. "forum"). Name is a glob relative to the owner's
+// directory; a trailing slash matches everything within (e.g.
+// "asn/messages/" or "news/"). Age is a duration with an optional day suffix
+// (e.g. "90d" or "36h").
+type Retention struct {
+	Type string `yaml:"type,omitempty"`
+	Name string
+	Age  string `yaml:"age,omitempty"`
+	Keep int    `yaml:"keep,omitempty"`
+}
+
+type Retentions []*Retention
+
+// these are never removed by retention
+var retainExempt = []string{
+	AsnAuth,
+	AsnAuthor,
+	AsnID,
+	AsnMark,
+	AsnUser,
+	AsnVisibility,
+}
+
+// nor is anything within these
+var retainExemptDirs = []string{
+	AsnHistory,
+	AsnPending,
+}
+
+// ParseAge returns the duration of the given age string.
+func ParseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil {
+			return 0, &Error{s, "invalid age"}
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+type retainee struct {
+	fn string
+	t  time.Time
+}
+
+type retainees []retainee
+
+func (l retainees) Len() int           { return len(l) }
+func (l retainees) Less(i, j int) bool { return l[i].t.After(l[j].t) }
+func (l retainees) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Retain applies the configured retention rules to all users. The expired
+// links are listed to w then, unless dryrun, removed through an asn/removals
+// blob of the server so that mirrors remove the same. This returns the
+// number of expired links.
+func (repos *Repos) Retain(x Sender, w io.Writer, dryrun bool) (int,
+	error) {
+	if len(repos.retain) == 0 {
+		return 0, nil
+	}
+	now := time.Now()
+	expired := make(map[string]struct{})
+	for _, rule := range repos.retain {
+		var cutoff time.Time
+		if rule.Age != "" {
+			age, err := ParseAge(rule.Age)
+			if err != nil {
+				return 0, err
+			}
+			cutoff = now.Add(-age)
+		}
+		err := repos.storage.Users(func(keystr string) error {
+			if rule.Type != "" &&
+				rule.Type != repos.userType(keystr) {
+				return nil
+			}
+			l, err := repos.retainees(keystr, rule.Name)
+			if err != nil {
+				return err
+			}
+			sort.Sort(l)
+			for i, r := range l {
+				if (rule.Keep > 0 && i >= rule.Keep) ||
+					(!cutoff.IsZero() && r.t.Before(cutoff)) {
+					expired[repos.DePrefix(r.fn)] = struct{}{}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	fns := make([]string, 0, len(expired))
+	for fn := range expired {
+		fns = append(fns, fn)
+	}
+	sort.Strings(fns)
+	buf := &bytes.Buffer{}
+	for _, fn := range fns {
+		fmt.Fprintln(w, fn)
+		fmt.Fprintln(buf, fn)
+	}
+	if dryrun {
+		return len(fns), nil
+	}
+	server := repos.users.User(repos.svc.Server.Pub.Encr)
+	blob := NewBlobWith(&server.key, &server.key, AsnRemovals, now)
+	defer blob.Free()
+	if _, err := repos.Store(x, Latest, blob, buf); err != nil {
+		return 0, err
+	}
+	return len(fns), nil
+}
+
+// retainees returns the links of the user that match the given name glob.
+// These are found by pathname and indexed link time so that the user's cache
+// isn't loaded.
+func (repos *Repos) retainees(keystr, name string) (l retainees,
+	err error) {
+	if strings.HasSuffix(name, "/") {
+		name += "*"
+	}
+	dn := repos.Join(userDN(keystr))
+	matches, err := repos.storage.Glob(filepath.Join(dn,
+		filepath.FromSlash(name)))
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		err = repos.storage.Walk(match, func(fn string) error {
+			rel := filepath.ToSlash(fn[len(dn)+1:])
+			for _, exempt := range retainExempt {
+				if rel == exempt {
+					return nil
+				}
+			}
+			for _, exempt := range retainExemptDirs {
+				if strings.HasPrefix(rel, exempt+"/") {
+					return nil
+				}
+			}
+			for _, list := range AsnPubEncrLists {
+				if strings.HasPrefix(rel, list) {
+					return nil
+				}
+			}
+			t, err := repos.LinkTime(fn)
+			if err == nil {
+				l = append(l, retainee{fn, t})
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// userType returns the content of the user's asn/user link without loading
+// the user's cache.
+func (repos *Repos) userType(keystr string) string {
+	f, err := repos.Open(repos.Join(userDN(keystr), AsnUser))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	if _, err = BlobSeek(f); err != nil {
+		return ""
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(f, 64))
+	return strings.TrimSpace(string(b))
+}
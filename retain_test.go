@@ -0,0 +1,136 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetain(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	repos.Set(Retentions{&Retention{Name: "news/", Keep: 1}})
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	now := time.Now()
+	for i, name := range []string{"news/a", "news/b", "other"} {
+		_, err := testStoreAt(repos, x, owner, owner, name, name,
+			now.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	older := repos.DePrefix(repos.Join(owner.Join("news/a")))
+	w := new(bytes.Buffer)
+	if n, err := repos.Retain(x, w, true); err != nil || n != 1 ||
+		strings.TrimSpace(w.String()) != older {
+		t.Fatal("dry run", n, err, w)
+	}
+	if _, err := repos.storage.Stat(repos.Join(older)); err != nil {
+		t.Error("dry run removed", older)
+	}
+	if n, err := repos.Retain(x, w, false); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if _, err := repos.storage.Stat(repos.Join(older)); err == nil {
+		t.Error("retained", older)
+	}
+	for _, name := range []string{"news/b", "other"} {
+		fn := repos.Join(owner.Join(name))
+		if _, err := repos.storage.Stat(fn); err != nil {
+			t.Error("removed", name)
+		}
+	}
+}
+
+func TestRetainExempt(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	repos.Set(Retentions{&Retention{Name: "asn/", Age: "1ns"}})
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	moderator := newTestUser(t, repos)
+	author := newTestUser(t, repos)
+	_, err := testStore(repos, x, owner, owner,
+		AsnModerators+"/"+moderator.FullString(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{AsnAuth, AsnUser, AsnVisibility} {
+		content := ""
+		switch name {
+		case AsnAuth:
+			content = strings.Repeat("a", PubAuthSz)
+		case AsnVisibility:
+			content = VisibilityPublic
+		}
+		if _, err = testStore(repos, x, owner, owner, name,
+			content); err != nil {
+			t.Fatal(name, err)
+		}
+	}
+	if _, err = testStore(repos, x, owner, author, AsnMessages,
+		"hello"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	w := new(bytes.Buffer)
+	if _, err = repos.Retain(x, w, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range strings.Fields(w.String()) {
+		_, name := repos.ParsePath(repos.Join(fn))
+		switch {
+		case name == AsnAuth, name == AsnUser, name == AsnVisibility,
+			strings.HasPrefix(name, AsnHistory+"/"),
+			strings.HasPrefix(name, AsnPending+"/"),
+			strings.HasPrefix(name, AsnModerators):
+			t.Error("expired", fn)
+		}
+	}
+}
+
+func TestRetainType(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	repos.Set(Retentions{&Retention{Type: "forum", Name: "news/",
+		Age: "1ns"}})
+	x := new(testSender)
+	forum := newTestUser(t, repos)
+	actual := newTestUser(t, repos)
+	if _, err := testStore(repos, x, forum, forum, AsnUser,
+		"forum\n"); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []*User{forum, actual} {
+		if _, err := testStore(repos, x, u, u, "news/a", "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond)
+	dn := forum.DN()
+	// the pass shouldn't load user caches
+	repos.users.Reset()
+	if err := repos.LoadUsers(); err != nil {
+		t.Fatal(err)
+	}
+	w := new(bytes.Buffer)
+	if n, err := repos.Retain(x, w, true); err != nil || n != 1 {
+		t.Fatal(n, err, w)
+	}
+	if !strings.HasPrefix(strings.TrimSpace(w.String()), dn) {
+		t.Error("expired", w)
+	}
+	repos.users.Lock()
+	for _, u := range repos.users.m {
+		if u.loaded {
+			t.Error("loaded", u)
+		}
+	}
+	repos.users.Unlock()
+}
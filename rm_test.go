@@ -0,0 +1,90 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+// testRM execs rm of the owner's named blob by the user.
+func testRM(repos *Repos, user, owner *User, name string) interface{} {
+	return newTestSes(repos, user).ExecRM(nil,
+		"~"+owner.FullString()+"/"+name)
+}
+
+func TestExecRMListKey(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	forum := newTestUser(t, repos)
+	a := newTestUser(t, repos)
+	b := newTestUser(t, repos)
+	for _, u := range []*User{a, b} {
+		_, err := testStore(repos, x, forum, forum,
+			AsnSubscribers+"/"+u.FullString(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// subscribers may only unsubscribe themselves
+	if v := testRM(repos, a, forum, AsnSubscribers+"/"+
+		b.FullString()); v != os.ErrPermission {
+		t.Error("unsubscribed other", v)
+	}
+	if v := testRM(repos, a, forum, AsnSubscribers+"/"+
+		a.FullString()); v == nil {
+		t.Error("unsubscribed nothing")
+	} else if _, ok := v.(*Sum); !ok {
+		t.Fatal(v)
+	}
+	if a.OnList(forum.cache.Subscribers()) ||
+		!b.OnList(forum.cache.Subscribers()) {
+		t.Error("subscribers", forum.cache.Subscribers())
+	}
+	fn := repos.Join(forum.Join(AsnSubscribers, a.FullString()))
+	if _, err := repos.storage.Stat(fn); err == nil {
+		t.Error("kept link of unsubscribed")
+	}
+}
+
+func TestExecRMListBlob(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	forum := newTestUser(t, repos)
+	a := newTestUser(t, repos)
+	b := newTestUser(t, repos)
+	l := PubEncrList{a.key, b.key}
+	blob := NewBlobWith(&forum.key, &forum.key, AsnInvites, time.Now())
+	defer blob.Free()
+	if _, err := repos.Store(x, Latest, blob, &l); err != nil {
+		t.Fatal(err)
+	}
+	name := AsnInvites + "/" + a.FullString()
+	if v := testRM(repos, b, forum, name); v != os.ErrPermission {
+		t.Error("uninvited other", v)
+	}
+	// there's no link to remove so the list is rewritten
+	if _, ok := testRM(repos, a, forum, name).(*Sum); !ok {
+		t.Fatal("uninvited from list blob")
+	}
+	if a.OnList(forum.cache.Invites()) || !b.OnList(forum.cache.Invites()) {
+		t.Error("invites", forum.cache.Invites())
+	}
+	s, err := testContent(repos, repos.Join(forum.Join(AsnInvites)))
+	if err != nil || !bytes.Equal([]byte(s), b.key.Bytes()) {
+		t.Error("rewritten list", []byte(s), err)
+	}
+	if _, ok := testRM(repos, forum, forum, AsnInvites+"/"+
+		b.FullString()).(*Sum); !ok {
+		t.Fatal("owner uninvited from list blob")
+	}
+	if len(forum.cache.Invites().Keys()) != 0 {
+		t.Error("invites", forum.cache.Invites())
+	}
+}
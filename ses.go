@@ -104,7 +104,7 @@ func (ses *Ses) RxLogin(pdu *PDU) (err error) {
 		ses.asn.Set(NewBox(2, &nonce, &ses.Keys.Client.Ephemeral,
 			&ses.Keys.Server.Ephemeral, sec))
 		if ses.user != nil {
-			ses.user.logins += 1
+			ses.user = ses.asn.repos.users.Login(ses.user)
 			if id := ses.user.cache.ID(); id != "" {
 				ses.asn.Set(id)
 			}
@@ -140,6 +140,18 @@ func (ses *Ses) Send(k *PubEncr, f *file.File) {
 	})
 }
 
+// Login returns the key of the session's user.
+func (ses *Ses) Login() *PubEncr { return &ses.Keys.Client.Login }
+
+// Watched sends a stored blob that matches one of the session's watches.
+func (ses *Ses) Watched(f *file.File) {
+	if dup, err := f.Dup(); err != nil {
+		ses.asn.Diag(err)
+	} else {
+		ses.asn.Tx(NewPDUFile(dup))
+	}
+}
+
 func (ses *Ses) Set(v interface{}) error {
 	switch t := v.(type) {
 	case *Config:
@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/apptimistco/asn/debug"
+	"github.com/apptimistco/asn/debug/file"
 	"github.com/apptimistco/asn/debug/mutex"
 	"golang.org/x/net/websocket"
 )
@@ -35,6 +36,7 @@ func NopCloserWriter(w io.Writer) io.WriteCloser {
 
 type SrvListener struct {
 	ln    Listener
+	url   *URL
 	stop  chan struct{}
 	done  chan error
 	ws    bool
@@ -66,11 +68,30 @@ func (cmd *Command) Server(args ...string) {
 		runtime.Goexit()
 	}
 	srv.Mutex.Set(cmd.Cfg.Name)
-	if err = srv.repos.Set(cmd.Cfg.Dir); err != nil {
+	var st Storage
+	if st, err = NewStorage(cmd.Cfg.Storage, cmd.Cfg.Dir); err != nil {
+		runtime.Goexit()
+	}
+	if err = srv.repos.Set(st); err != nil {
 		runtime.Goexit()
 	}
-	srv.repos.Set(cmd.Cfg.Keys)
 	defer func() { srv.repos.Reset() }()
+	for _, v := range []interface{}{
+		cmd.Cfg.Dir,
+		cmd.Cfg.Keys,
+		cmd.Cfg.Quota,
+		cmd.Cfg.Retain,
+		cmd.Cfg.GC,
+		cmd.Cfg.History,
+		cmd.Cfg.BridgeServers(),
+	} {
+		if err = srv.repos.Set(v); err != nil {
+			runtime.Goexit()
+		}
+	}
+	if err = srv.repos.users.Set(cmd.Cfg.UserCache); err != nil {
+		runtime.Goexit()
+	}
 	for _, k := range []*UserKeys{
 		srv.cmd.Cfg.Keys.Admin,
 		srv.cmd.Cfg.Keys.Server,
@@ -84,6 +105,7 @@ func (cmd *Command) Server(args ...string) {
 			user.cache.Auth().Set(k.Pub.Auth)
 			user.cache.Author().Set(k.Pub.Encr)
 		}
+		user.pinned = true
 		user = nil
 	}
 	if len(args) > 0 {
@@ -105,6 +127,9 @@ func (cmd *Command) Server(args ...string) {
 		v = nil
 		runtime.Goexit()
 	}
+	if err = srv.repos.Recover(srv); err != nil {
+		runtime.Goexit()
+	}
 	if err = srv.Listen(); err != nil {
 		runtime.Goexit()
 	}
@@ -114,25 +139,127 @@ func (cmd *Command) Server(args ...string) {
 	cmd.Stderr.Close()
 	cmd.Stderr = NopCloserWriter(ioutil.Discard)
 	sigch := make(chan os.Signal, 2)
-	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1,
+		syscall.SIGUSR2)
 	defer signal.Stop(sigch)
+	var drained chan struct{}
+	var retainInterval, gcInterval time.Duration
+	if len(cmd.Cfg.Retain) > 0 {
+		retainInterval = RetainInterval
+	}
+	if cmd.Cfg.GC != nil && cmd.Cfg.GC.Interval != "" {
+		gcInterval, err = ParseAge(cmd.Cfg.GC.Interval)
+		if err != nil {
+			runtime.Goexit()
+		}
+	}
+	retain := srv.NewJob("retain", retainInterval, func() {
+		n, xerr := srv.repos.Retain(srv, ioutil.Discard, false)
+		if xerr != nil {
+			srv.Log("retain", xerr)
+		} else if n > 0 {
+			srv.Log("retain removed", n)
+		}
+	})
+	defer retain.Stop()
+	gc := srv.NewJob("gc", gcInterval, func() {
+		stats, xerr := srv.repos.GC(nil, Time0, false)
+		if xerr != nil {
+			srv.Log("gc", xerr)
+		} else if stats.Blobs > 0 {
+			srv.Log("gc reclaimed", stats)
+		}
+	})
+	defer gc.Stop()
 	for {
-		sig := <-sigch
-		srv.Diag("caught", sig)
-		switch sig {
-		case syscall.SIGINT:
-			debug.Trace.WriteTo(debug.Log)
-			srv.Close()
-			srv.Hangup()
+		select {
+		case sig := <-sigch:
+			srv.Diag("caught", sig)
+			switch sig {
+			case syscall.SIGINT:
+				debug.Trace.WriteTo(debug.Log)
+				srv.Close()
+				srv.Hangup()
+				runtime.Goexit()
+			case syscall.SIGTERM:
+				srv.Close()
+			case syscall.SIGUSR1:
+				debug.Trace.WriteTo(debug.Log)
+			case syscall.SIGUSR2:
+				if drained != nil {
+					break
+				}
+				if xerr := srv.Handoff(); xerr != nil {
+					srv.Log("handoff", xerr)
+					break
+				}
+				srv.Close()
+				// the successor runs these
+				retain.Stop()
+				gc.Stop()
+				drained = make(chan struct{})
+				go func() {
+					srv.Drain()
+					close(drained)
+				}()
+			}
+		case <-retain.C:
+			retain.Run()
+		case <-gc.C:
+			gc.Run()
+		case <-drained:
+			srv.Log("drained")
 			runtime.Goexit()
-		case syscall.SIGTERM:
-			srv.Close()
-		case syscall.SIGUSR1:
-			debug.Trace.WriteTo(debug.Log)
 		}
 	}
 }
 
+// SrvJob periodically runs a background function unless the previous run
+// hasn't finished.
+type SrvJob struct {
+	C      <-chan time.Time
+	srv    *Server
+	name   string
+	ticker *time.Ticker
+	busy   chan struct{}
+	f      func()
+}
+
+// NewJob returns a SrvJob that never ticks if the interval is zero.
+func (srv *Server) NewJob(name string, d time.Duration, f func()) *SrvJob {
+	job := &SrvJob{
+		srv:  srv,
+		name: name,
+		busy: make(chan struct{}, 1),
+		f:    f,
+	}
+	if d > 0 {
+		job.ticker = time.NewTicker(d)
+		job.C = job.ticker.C
+	}
+	return job
+}
+
+func (job *SrvJob) Run() {
+	select {
+	case job.busy <- struct{}{}:
+		go func() {
+			defer func() { <-job.busy }()
+			job.f()
+		}()
+	default:
+		job.srv.Diag(job.name, "already running")
+	}
+}
+
+func (job *SrvJob) Stop() {
+	if job.ticker != nil {
+		job.ticker.Stop()
+		job.ticker = nil
+	}
+	job.C = nil
+}
+
 func (srv *Server) AddListener(l *SrvListener) {
 	srv.Lock()
 	defer srv.Unlock()
@@ -161,6 +288,13 @@ func (srv *Server) Close() {
 	srv.listeners = nil
 }
 
+// Drain waits for all sessions to end.
+func (srv *Server) Drain() {
+	for srv.active() > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 func (srv *Server) ForEachLogin(f func(*Ses)) {
 	srv.Lock()
 	defer srv.Unlock()
@@ -171,6 +305,20 @@ func (srv *Server) ForEachLogin(f func(*Ses)) {
 	}
 }
 
+// Send the file to each session logged in with the given key.
+func (srv *Server) Send(k *PubEncr, f *file.File) {
+	f.Seek(0, os.SEEK_SET)
+	srv.ForEachLogin(func(x *Ses) {
+		if bytes.Equal(x.Keys.Client.Login.Bytes(), k.Bytes()) {
+			if dup, err := f.Dup(); err != nil {
+				srv.Diag(err)
+			} else {
+				x.asn.Tx(NewPDUFile(dup))
+			}
+		}
+	})
+}
+
 func (srv *Server) handler(conn net.Conn) {
 	var ses Ses
 	svc := srv.cmd.Cfg.Keys
@@ -197,11 +345,9 @@ func (srv *Server) handler(conn net.Conn) {
 				panic("can't close connection")
 			}
 		}
-		user := srv.repos.users.User(&ses.Keys.Client.Login)
-		if user != nil && user.logins > 0 {
-			user.logins -= 1
-		}
+		srv.repos.users.Logout(&ses.Keys.Client.Login)
 		srv.rm(&ses)
+		srv.repos.Unwatch(&ses, nil, "")
 		ses.asn.Log("disconnected @", time.Now(),
 			"\n\tclient:", &ses.Keys.Client.Ephemeral,
 		)
@@ -284,26 +430,26 @@ func (srv *Server) Hangup() {
 		}
 	}
 	srv.Unlock()
-	for {
-		active := 0
-		srv.Lock()
-		for _, ses := range srv.sessions {
-			if ses != nil {
-				active += 1
-			}
-		}
-		srv.Unlock()
-		if active == 0 {
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
-	}
+	srv.Drain()
 	srv.sessions = nil
 }
 
+// Listen on each configured URL. Rather than create a new socket, this uses
+// any matching listener inherited through systemd socket activation or a
+// server handoff.
 func (srv *Server) Listen() error {
+	if err := InheritErr(); err != nil {
+		srv.Log(err)
+		return err
+	}
+	defer func() {
+		for _, name := range Uninherited() {
+			srv.Log("closed unclaimed inherited listener", name)
+		}
+	}()
 	for _, lurl := range srv.cmd.Cfg.Listen {
 		l := &SrvListener{
+			url:  lurl,
 			stop: make(chan struct{}, 1),
 			done: make(chan error, 1),
 		}
@@ -313,8 +459,10 @@ func (srv *Server) Listen() error {
 			if err != nil {
 				return err
 			}
-			l.ln, err = net.ListenTCP(lurl.Scheme, addr)
-			if err != nil {
+			if l.ln = Inherit(addr); l.ln != nil {
+				srv.Log("inherited", addr)
+			} else if l.ln, err = net.ListenTCP(lurl.Scheme,
+				addr); err != nil {
 				return err
 			}
 			srv.AddListener(l)
@@ -322,14 +470,18 @@ func (srv *Server) Listen() error {
 			go l.listen(srv)
 		case "unix":
 			path := UrlPathSearch(lurl.Path)
-			os.Remove(path)
 			addr, err := net.ResolveUnixAddr(lurl.Scheme, path)
 			if err != nil {
 				return err
 			}
-			l.ln, err = net.ListenUnix(lurl.Scheme, addr)
-			if err != nil {
-				return err
+			if l.ln = Inherit(addr); l.ln != nil {
+				srv.Log("inherited", addr)
+			} else {
+				os.Remove(path)
+				l.ln, err = net.ListenUnix(lurl.Scheme, addr)
+				if err != nil {
+					return err
+				}
 			}
 			srv.AddListener(l)
 			l.clean = path
@@ -344,7 +496,10 @@ func (srv *Server) Listen() error {
 			if err != nil {
 				return err
 			}
-			if l.ln, err = net.ListenTCP("tcp", addr); err != nil {
+			if l.ln = Inherit(addr); l.ln != nil {
+				srv.Log("inherited", addr)
+			} else if l.ln, err = net.ListenTCP("tcp",
+				addr); err != nil {
 				return err
 			}
 			srv.AddListener(l)
@@ -379,6 +534,17 @@ func (srv *Server) Listen() error {
 	return nil
 }
 
+func (srv *Server) active() (n int) {
+	srv.Lock()
+	defer srv.Unlock()
+	for _, ses := range srv.sessions {
+		if ses != nil {
+			n += 1
+		}
+	}
+	return
+}
+
 func (srv *Server) add(ses *Ses) {
 	srv.Lock()
 	defer srv.Unlock()
@@ -0,0 +1,57 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/apptimistco/asn/debug/file"
+)
+
+// Storage is a Repos backend of blob sum files and the links that name them.
+// Pathnames are those made by Repos.Join; sum files are REPOS/SUM[:2]/SUM[2:]
+// and links are REPOS/USER[:2]/USER[2:]/NAME.
+type Storage interface {
+	// Store the named tmp file as the given sum file; this fails with
+	// os.ErrExist if the sum file is already stored.
+	Store(tmpfn, pn string) error
+	// Link dst to the blob of src, replacing any existing dst.
+	Link(src, dst string) error
+	// Unlink the named sum file or link.
+	Unlink(pn string) error
+	// Mkdir creates the named user directory, if necessary.
+	Mkdir(pn string) error
+	// RemoveAll links at or below the named directory.
+	RemoveAll(pn string) error
+	// Open the named sum file or link for reading.
+	Open(pn string) (*file.File, error)
+	// Stat returns the FileInfo of the named sum file, link or directory.
+	Stat(pn string) (os.FileInfo, error)
+	// Nlink returns the number of references to the named blob including
+	// its sum file.
+	Nlink(pn string) (int, error)
+	// Search returns the unique sum file with the given hex prefix.
+	Search(prefix string) (string, error)
+	// Glob returns the links or directories that match pattern.
+	Glob(pattern string) ([]string, error)
+	// Walk calls f with each link at or below the named one.
+	Walk(pn string, f func(pn string) error) error
+	// Filter calls f with each sum file of a blob made after epoch.
+	Filter(epoch time.Time, f func(pn string) error) error
+	// Users calls f with the key string of each user directory.
+	Users(f func(keystr string) error) error
+}
+
+// NewStorage returns the named Repos backend, "fs" (default) or "mem".
+func NewStorage(name, dn string) (Storage, error) {
+	switch name {
+	case "", "fs":
+		return NewFSStorage(dn), nil
+	case "mem":
+		return NewMemStorage(dn)
+	}
+	return nil, &Error{name, "unknown storage"}
+}
@@ -0,0 +1,120 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStorage(t *testing.T) {
+	for _, name := range []string{"fs", "mem"} {
+		testStorage(t, name)
+	}
+}
+
+func testStorage(t *testing.T, name string) {
+	repos := newTestRepos(t, name)
+	defer freeTestRepos(repos)
+	st := repos.storage
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	sum, err := testStore(repos, x, owner, owner, "a", "content of a")
+	if err != nil {
+		t.Fatal(name, err)
+	}
+	sumFN := repos.Join(sum.PN())
+	afn := repos.Join(owner.Join("a"))
+	bfn := repos.Join(owner.Join("b"))
+	nlink, err := st.Nlink(sumFN)
+	if err != nil || nlink < 2 {
+		t.Error(name, "nlink", nlink, err)
+	}
+	f := repos.tmp.New()
+	f.Write([]byte("other"))
+	if err = st.Store(f.Name(), sumFN); err != os.ErrExist {
+		t.Error(name, "restored", sumFN, err)
+	}
+	repos.tmp.Free(f)
+	if err = st.Link(sumFN, bfn); err != nil {
+		t.Fatal(name, err)
+	}
+	if n, _ := st.Nlink(afn); n != nlink+1 {
+		t.Error(name, "nlink after link", n)
+	}
+	if s, err := testContent(repos, bfn); err != nil || s != "content of a" {
+		t.Error(name, "link content", s, err)
+	}
+	if err = st.Unlink(bfn); err != nil {
+		t.Error(name, err)
+	}
+	if err = st.Unlink(bfn); !os.IsNotExist(err) {
+		t.Error(name, "unlinked twice", err)
+	}
+	if _, err = st.Stat(bfn); !os.IsNotExist(err) {
+		t.Error(name, "stat unlinked", err)
+	}
+	if _, err = st.Open(bfn); !os.IsNotExist(err) {
+		t.Error(name, "open unlinked", err)
+	}
+	if fn, err := st.Search(sum.FullString()[:16]); err != nil ||
+		fn != sumFN {
+		t.Error(name, "search", fn, err)
+	}
+	other := sum.FullString()[:ReposTopSz] + "x"
+	if fn, _ := st.Search(other); fn != "" {
+		t.Error(name, "search", other, fn)
+	}
+	if m, err := st.Glob(repos.Join(owner.Join("*"))); err != nil ||
+		!testHas(m, afn) || testHas(m, bfn) {
+		t.Error(name, "glob", m, err)
+	}
+	var walked []string
+	st.Walk(repos.Join(owner.DN()), func(fn string) error {
+		walked = append(walked, fn)
+		return nil
+	})
+	if !testHas(walked, afn) {
+		t.Error(name, "walk", walked)
+	}
+	var keys []string
+	st.Users(func(keystr string) error {
+		keys = append(keys, keystr)
+		return nil
+	})
+	if !testHas(keys, owner.FullString()) {
+		t.Error(name, "users", keys)
+	}
+	var filtered []string
+	filter := func(fn string) error {
+		filtered = append(filtered, fn)
+		return nil
+	}
+	st.Filter(time.Time{}, filter)
+	if !testHas(filtered, sumFN) {
+		t.Error(name, "filter", filtered)
+	}
+	filtered = nil
+	st.Filter(time.Now().Add(time.Hour), filter)
+	if testHas(filtered, sumFN) {
+		t.Error(name, "filtered future", filtered)
+	}
+	if err = st.RemoveAll(repos.Join(owner.DN())); err != nil {
+		t.Error(name, err)
+	}
+	if _, err = st.Stat(afn); !os.IsNotExist(err) {
+		t.Error(name, "stat removed", err)
+	}
+}
+
+func testHas(l []string, s string) bool {
+	for _, x := range l {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
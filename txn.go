@@ -0,0 +1,274 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apptimistco/asn/debug/file"
+)
+
+// txnEntry is a blob of a transaction and the link that it replaces.
+type txnEntry struct {
+	f     *file.File
+	fh    FH
+	owner *User
+	fn    string // owner's link
+	prev  string // sum file of the replaced link, if any
+	sum   *Sum   // of the blob linked by this transaction, if any
+	found bool   // sum file stored before this transaction
+}
+
+// txnSender holds the sends of a transaction's blobs, and their pushes to
+// watchers, until all are linked; mirror sends are dropped as the mirrors
+// receive the whole transaction instead. Its caller holds the repos.cas lock.
+type txnSender struct {
+	Sender
+	held *[]txnHeld
+}
+
+// txnHeld is a dup of a transaction's blob and its deferred send or push.
+type txnHeld struct {
+	f    *file.File
+	push func(*file.File)
+}
+
+func (x txnSender) Send(k *PubEncr, f *file.File) {
+	if k != Mirrors {
+		key := *k
+		x.hold(f, func(f *file.File) { x.Sender.Send(&key, f) })
+	}
+}
+
+// hold a dup of the blob file for its push once the transaction is linked.
+func (x txnSender) hold(f *file.File, push func(*file.File)) {
+	dup, err := f.Dup()
+	if err != nil {
+		f.Diag(err)
+		return
+	}
+	*x.held = append(*x.held, txnHeld{dup, push})
+}
+
+// flush the held pushes, unless the transaction failed, then close their
+// dups.
+func (x txnSender) flush(failed bool) {
+	for _, h := range *x.held {
+		if !failed {
+			h.push(h.f)
+		}
+		h.f.Close()
+	}
+	*x.held = nil
+}
+
+// WriteTxnBlob writes a blob of the given size content to the w content of
+// an AsnTransaction blob and returns its sum.
+func WriteTxnBlob(w io.Writer, owner, author *User, name string,
+	t time.Time, r io.Reader, size int64) (*Sum, error) {
+	blob := NewBlobWith(&owner.key, &author.key, name, t)
+	defer blob.Free()
+	hdr := &bytes.Buffer{}
+	Latest.WriteTo(hdr)
+	BlobId.Version(Latest).WriteTo(hdr)
+	if _, err := blob.WriteTo(hdr); err != nil {
+		return nil, err
+	}
+	_, err := (NBOWriter{w}).WriteNBO(uint64(int64(hdr.Len()) + size))
+	if err != nil {
+		return nil, err
+	}
+	h := sha512.New()
+	m := io.MultiWriter(w, h)
+	if _, err = hdr.WriteTo(m); err != nil {
+		return nil, err
+	}
+	if _, err = io.CopyN(m, r, size); err != nil {
+		return nil, err
+	}
+	sum := new(Sum)
+	copy(sum[:], h.Sum([]byte{}))
+	return sum, nil
+}
+
+// Transaction stores and links each blob of an AsnTransaction or, if any
+// can't be, none of them. These must be named, permitted blobs of the same
+// author that are newer than those they replace. Their sends and pushes to
+// watchers are held until all are linked.
+func (repos *Repos) Transaction(x Sender, f *file.File, blob *Blob) (err error) {
+	var l []*txnEntry
+	defer func() {
+		for _, e := range l {
+			repos.tmp.Free(e.f)
+			if e.owner != nil {
+				repos.users.Release(e.owner)
+			}
+		}
+	}()
+	if _, err = BlobSeek(f); err != nil {
+		return
+	}
+	author := repos.User(&blob.Author)
+	for {
+		var size uint64
+		if _, err = (NBOReader{f}).ReadNBO(&size); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		e := &txnEntry{f: repos.tmp.New()}
+		l = append(l, e)
+		if _, err = io.CopyN(e.f, f, int64(size)); err != nil {
+			return &Error{AsnTransaction, "truncated"}
+		}
+		e.f.Seek(0, os.SEEK_SET)
+		if _, err = e.fh.ReadFrom(e.f); err != nil {
+			return
+		}
+		name := e.fh.Blob.Name
+		switch {
+		case e.fh.Id != BlobId:
+			return &Error{AsnTransaction, "not a blob"}
+		case !bytes.Equal(e.fh.Blob.Author.Bytes(), blob.Author.Bytes()):
+			return &Error{name, "not the transaction author"}
+		case !indexLinked(name), name == AsnMark, name == AsnHistory,
+			strings.HasPrefix(name, AsnHistory+"/"), name == AsnPending,
+			strings.HasPrefix(name, AsnPending+"/"):
+			return &Error{name, "may not be in a transaction"}
+		}
+		for _, fn := range AsnPubEncrLists {
+			if strings.HasPrefix(name, fn+"/") {
+				if _, err = NewPubEncr(name[len(fn)+1:]); err != nil {
+					return
+				}
+			}
+		}
+		// keep the owner resident for undo
+		e.owner = repos.users.Hold(repos.User(&e.fh.Blob.Owner))
+		if err = repos.Permission(e.owner, author, name); err != nil {
+			return
+		}
+		e.fn = repos.Join(e.owner.Join(name))
+		for _, o := range l[:len(l)-1] {
+			if o.fn == e.fn {
+				return &Error{name, "repeated in transaction"}
+			}
+		}
+	}
+	if len(l) == 0 {
+		return &Error{AsnTransaction, "empty"}
+	}
+	repos.cas.Lock()
+	defer repos.cas.Unlock()
+	for _, e := range l {
+		if _, xerr := repos.storage.Stat(e.fn); xerr != nil {
+			continue
+		}
+		if t, xerr := repos.LinkTime(e.fn); xerr == nil &&
+			t.After(e.fh.Blob.Time) {
+			return ErrConflict
+		}
+		cur, xerr := repos.Open(e.fn)
+		if xerr != nil {
+			return xerr
+		}
+		e.prev = repos.Join(NewSumOf(cur).PN())
+		cur.Close()
+		if _, err = repos.storage.Stat(e.prev); err != nil {
+			return &Error{e.fh.Blob.Name, "can't be replaced"}
+		}
+	}
+	xt := txnSender{x, new([]txnHeld)}
+	defer func() { xt.flush(err != nil) }()
+	for i, e := range l {
+		// Store writes the version and id then tees the blob header
+		e.f.Seek(0, os.SEEK_SET)
+		e.fh.V.ReadFrom(e.f)
+		e.fh.Id.ReadFrom(e.f)
+		sum, xerr := repos.Store(xt, e.fh.V, nil, e.f)
+		if os.IsExist(xerr) {
+			// an identical blob is committed unless its store
+			// was interrupted before linking
+			if repos.txnLinked(e, sum) {
+				continue
+			}
+			e.sum, e.found = sum, true
+			xerr = repos.recoverStore(xt, sum.FullString())
+		} else if xerr == nil {
+			e.sum = sum
+		}
+		if err = xerr; err != nil {
+			repos.undo(l[:i+1])
+			return
+		}
+	}
+	return
+}
+
+// txnLinked returns true if the entry's owner has its link, or queued link,
+// of the given sum.
+func (repos *Repos) txnLinked(e *txnEntry, sum *Sum) bool {
+	if repos.pending(sum, &e.fh.Blob) != "" {
+		return true
+	}
+	cur, err := repos.Open(e.fn)
+	if err != nil {
+		return false
+	}
+	defer cur.Close()
+	return *NewSumOf(cur) == *sum
+}
+
+// undo the blobs linked by a failed transaction, relinking those that they
+// replaced, then reload the caches of their held owners in place. Sum files
+// stored before the transaction are kept.
+func (repos *Repos) undo(l []*txnEntry) {
+	unlink := func(fn string) {
+		if _, err := repos.storage.Stat(fn); err == nil {
+			repos.Unlink(fn)
+		}
+	}
+	owners := make(map[*User]struct{})
+	for i := len(l) - 1; i >= 0; i-- {
+		e := l[i]
+		owners[e.owner] = struct{}{}
+		if e.sum == nil {
+			continue
+		}
+		if cur, err := repos.Open(e.fn); err == nil {
+			sum := NewSumOf(cur)
+			cur.Close()
+			if *sum == *e.sum {
+				repos.Unlink(e.fn)
+			}
+		}
+		if !e.found {
+			unlink(repos.Join(e.owner.Join(AsnHistory,
+				e.fh.Blob.Name, e.fh.Blob.FN(e.sum))))
+			unlink(repos.Join(e.owner.Join(AsnPending,
+				e.fh.Blob.FN(e.sum))))
+			unlink(repos.Join(e.sum.PN()))
+		}
+		if _, err := repos.storage.Stat(e.fn); err != nil && e.prev != "" {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						repos.Diag(r)
+					}
+				}()
+				repos.LN(e.prev, e.fn)
+			}()
+		}
+	}
+	for owner := range owners {
+		repos.reloadCache(owner)
+	}
+}
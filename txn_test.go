@@ -0,0 +1,276 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apptimistco/asn/debug/file"
+)
+
+// testTxnEntry is a blob of a test transaction.
+type testTxnEntry struct {
+	owner         *User
+	name, content string
+}
+
+// testTxnBlobs returns the AsnTransaction content of the author's blobs of
+// the given entries.
+func testTxnBlobs(t *testing.T, author *User, l ...testTxnEntry) []byte {
+	tm := time.Now()
+	b := new(bytes.Buffer)
+	for _, e := range l {
+		_, err := WriteTxnBlob(b, e.owner, author, e.name, tm,
+			strings.NewReader(e.content), int64(len(e.content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+// testTxnFile returns a temporary file of an AsnTransaction blob of the
+// author with the given entries and its sum.
+func testTxnFile(t *testing.T, repos *Repos, author *User,
+	l ...testTxnEntry) (*file.File, *Sum) {
+	return testTxnFileOf(t, repos, author, testTxnBlobs(t, author, l...))
+}
+
+// testTxnFileOf returns a temporary file of an AsnTransaction blob of the
+// author with the given content and its sum.
+func testTxnFileOf(t *testing.T, repos *Repos, author *User,
+	content []byte) (*file.File, *Sum) {
+	blob := NewBlobWith(&author.key, &author.key, AsnTransaction,
+		time.Now())
+	defer blob.Free()
+	f := repos.tmp.New()
+	Latest.WriteTo(f)
+	BlobId.Version(Latest).WriteTo(f)
+	if _, err := blob.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Write(content)
+	f.Seek(0, os.SEEK_SET)
+	sum := NewSumOf(f)
+	f.Seek(0, os.SEEK_SET)
+	return f, sum
+}
+
+// testTxn stores a transaction of the author with the given entries.
+func testTxn(t *testing.T, repos *Repos, x Sender, author *User,
+	l ...testTxnEntry) error {
+	f, _ := testTxnFile(t, repos, author, l...)
+	defer repos.tmp.Free(f)
+	return testTxnStore(t, repos, x, author, f)
+}
+
+// testTxnStore stores the transaction file of the author from its start.
+func testTxnStore(t *testing.T, repos *Repos, x Sender, author *User,
+	f *file.File) error {
+	f.Seek(0, os.SEEK_SET)
+	var fh FH
+	if _, err := fh.ReadFrom(f); err != nil {
+		t.Fatal(err)
+	}
+	blob := NewBlobWith(&author.key, &author.key, AsnTransaction,
+		fh.Blob.Time)
+	defer blob.Free()
+	_, err := repos.Store(x, Latest, blob, f)
+	return err
+}
+
+// testTxnWatcher counts the pushed blobs and those before all of the
+// transaction's links.
+type testTxnWatcher struct {
+	testWatcher
+	repos *Repos
+	fns   []string
+	early int
+}
+
+func (w *testTxnWatcher) Watched(f *file.File) {
+	for _, fn := range w.fns {
+		if _, err := w.repos.storage.Stat(fn); err != nil {
+			w.Lock()
+			w.early++
+			w.Unlock()
+			break
+		}
+	}
+	w.testWatcher.Watched(f)
+}
+
+func TestTxnHeld(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	w := &testTxnWatcher{repos: repos}
+	w.key = owner.key
+	w.fns = []string{
+		repos.Join(owner.Join("a")),
+		repos.Join(owner.Join("b")),
+	}
+	if err := repos.Watch(w, nil, "*"); err != nil {
+		t.Fatal(err)
+	}
+	// the empty auth fails the transaction after storing the others
+	err := testTxn(t, repos, x, owner,
+		testTxnEntry{owner, "a", "1"},
+		testTxnEntry{owner, "b", "2"},
+		testTxnEntry{owner, AsnAuth, ""})
+	if err == nil {
+		t.Fatal("stored transaction with empty auth")
+	}
+	if n := w.Count(); n != 0 {
+		t.Error("pushed", n, "of failed transaction")
+	}
+	if _, err = repos.storage.Stat(w.fns[0]); err == nil {
+		t.Error("failed transaction wasn't undone")
+	}
+	err = testTxn(t, repos, x, owner,
+		testTxnEntry{owner, "a", "1"},
+		testTxnEntry{owner, "b", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := w.Count(); n != 2 || w.early != 0 {
+		t.Error("pushed", n, "with", w.early, "before linked")
+	}
+}
+
+func TestTxnUndo(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	moderator := newTestUser(t, repos)
+	e := owner.cache[AsnModerators]
+	err := testTxn(t, repos, x, owner,
+		testTxnEntry{owner, AsnModerators + "/" + moderator.FullString(),
+			""},
+		testTxnEntry{owner, AsnAuth, ""})
+	if err == nil {
+		t.Fatal("stored transaction with empty auth")
+	}
+	if owner.cache[AsnModerators] != e {
+		t.Error("cache entry was replaced")
+	}
+	if l := owner.cache.Moderators(); len(*l) != 0 {
+		t.Error("undone moderators", l)
+	}
+}
+
+func TestTxnRepeat(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	blobs := testTxnBlobs(t, owner,
+		testTxnEntry{owner, "a", "1"},
+		testTxnEntry{owner, "b", "2"})
+	f, _ := testTxnFileOf(t, repos, owner, blobs)
+	defer repos.tmp.Free(f)
+	for i := 0; i < 2; i++ {
+		if err := testTxnStore(t, repos, x, owner, f); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	linked := func(when string) {
+		for name, content := range map[string]string{
+			"a": "1",
+			"b": "2",
+		} {
+			fn := repos.Join(owner.Join(name))
+			s, err := testContent(repos, fn)
+			if err != nil || s != content {
+				t.Error(when, "lost", name, s, err)
+			}
+		}
+	}
+	linked("repeated")
+	// the empty auth fails a transaction repeating the committed blobs
+	g, _ := testTxnFileOf(t, repos, owner, append(blobs,
+		testTxnBlobs(t, owner, testTxnEntry{owner, AsnAuth, ""})...))
+	defer repos.tmp.Free(g)
+	if err := testTxnStore(t, repos, x, owner, g); err == nil {
+		t.Fatal("stored transaction with empty auth")
+	}
+	linked("undone")
+}
+
+func TestTxnJournal(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	err := testTxn(t, repos, x, owner,
+		testTxnEntry{owner, "a", "1"},
+		testTxnEntry{owner, "b", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stores, links int
+	for _, v := range testJournal(t, repos, 0) {
+		switch v[0] {
+		case JournalStore:
+			stores++
+		case JournalLink:
+			links++
+		}
+	}
+	if stores != 1 || links < 2 {
+		t.Error("journaled", stores, "stores and", links, "links")
+	}
+}
+
+func TestTxnRecover(t *testing.T) {
+	repos := newTestRepos(t, "fs")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	// crash after storing the transaction and its first blob but before
+	// linking them
+	blobs := testTxnBlobs(t, owner,
+		testTxnEntry{owner, "a", "1"},
+		testTxnEntry{owner, "b", "2"})
+	f, sum := testTxnFileOf(t, repos, owner, blobs)
+	defer repos.tmp.Free(f)
+	repos.journal.append(JournalStore, sum.FullString())
+	err := repos.storage.Store(f.Name(), repos.Join(sum.PN()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size uint64
+	r := bytes.NewReader(blobs)
+	(NBOReader{r}).ReadNBO(&size)
+	first := blobs[8 : 8+size]
+	a := repos.tmp.New()
+	defer repos.tmp.Free(a)
+	a.Write(first)
+	aFN := repos.Join(NewSumOf(bytes.NewReader(first)).PN())
+	if err = repos.storage.Store(a.Name(), aFN); err != nil {
+		t.Fatal(err)
+	}
+	if err = repos.LoadJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if err = repos.Recover(x); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"a": "1", "b": "2"} {
+		s, err := testContent(repos, repos.Join(owner.Join(name)))
+		if err != nil || s != content {
+			t.Error("unrecovered", name, s, err)
+		}
+	}
+	if _, err = repos.storage.Stat(repos.Join(sum.PN())); err == nil {
+		t.Error("retained transaction sum file")
+	}
+}
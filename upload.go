@@ -0,0 +1,289 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apptimistco/asn/debug/file"
+	"github.com/apptimistco/asn/debug/mutex"
+)
+
+const (
+	// ReposUploadsDN is the directory of unfinished uploads beside that of
+	// the repos tmp files.
+	ReposUploadsDN = "uploads"
+	UploadIdSz     = 8
+	UploadChunkSz  = 64 * 1024
+	// UploadExpiry is the age of abandoned uploads that are removed.
+	UploadExpiry  = 24 * time.Hour
+	uploadMetaExt = ".meta"
+)
+
+// Upload is an unfinished blob that is received in acknowledged chunks. Its
+// content is appended to a file named by its ID that's described by another
+// with a single line of:
+//
+//	OWNER AUTHOR SIZE NAME
+type Upload struct {
+	ID     string
+	Owner  string // full key string
+	Author string // "
+	Size   int64
+	Name   string
+	fn     string
+}
+
+// Offset returns the number of bytes received.
+func (up *Upload) Offset() (int64, error) {
+	fi, err := os.Stat(up.fn)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (up *Upload) String() string {
+	off, _ := up.Offset()
+	return fmt.Sprintln(up.ID, off)
+}
+
+type reposUploads struct {
+	mutex.Mutex
+	dn string
+}
+
+// IsUploadId returns true if the given string may be an upload ID.
+func IsUploadId(s string) bool {
+	return len(s) == 2*UploadIdSz && IsHex(s)
+}
+
+// readUpload from the description of the given ID; the caller must hold the
+// lock.
+func (uploads *reposUploads) readUpload(id string) (*Upload, error) {
+	b, err := ioutil.ReadFile(filepath.Join(uploads.dn, id+uploadMetaExt))
+	if err != nil {
+		return nil, err
+	}
+	up := &Upload{ID: id, fn: filepath.Join(uploads.dn, id)}
+	v := strings.SplitN(strings.TrimSuffix(string(b), "\n"), " ", 4)
+	if len(v) != 4 {
+		return nil, &Error{id, "invalid upload"}
+	}
+	if _, err = fmt.Sscan(v[2], &up.Size); err != nil {
+		return nil, &Error{id, "invalid upload size"}
+	}
+	up.Owner, up.Author, up.Name = v[0], v[1], v[3]
+	return up, nil
+}
+
+// remove the content and description of the given upload.
+func (uploads *reposUploads) remove(id string) {
+	fn := filepath.Join(uploads.dn, id)
+	os.Remove(fn + uploadMetaExt)
+	os.Remove(fn)
+}
+
+// usage removes the expired uploads and returns the sum of the sizes and
+// number of those remaining by the given author; the caller must hold the
+// lock.
+func (uploads *reposUploads) usage(author string) (u QuotaUsage) {
+	fis, err := ioutil.ReadDir(uploads.dn)
+	if err != nil {
+		return
+	}
+	expired := time.Now().Add(-UploadExpiry)
+	for _, fi := range fis {
+		id := strings.TrimSuffix(fi.Name(), uploadMetaExt)
+		if id == fi.Name() || !IsUploadId(id) {
+			continue
+		}
+		if fi.ModTime().Before(expired) {
+			if cfi, err := os.Stat(filepath.Join(uploads.dn, id)); err != nil ||
+				cfi.ModTime().Before(expired) {
+				uploads.Diag("expired upload", id)
+				uploads.remove(id)
+				continue
+			}
+		}
+		up, err := uploads.readUpload(id)
+		if err == nil && up.Author == author {
+			u.Bytes += up.Size
+			u.Blobs += 1
+		}
+	}
+	return
+}
+
+// NewUpload begins the upload of the named blob with the given content size
+// if the author's quota has room for it beside their unfinished uploads. An
+// interrupted upload is resumed with its ID.
+func (repos *Repos) NewUpload(owner, author *User, name string,
+	size int64) (*Upload, error) {
+	if size < 0 {
+		return nil, os.ErrInvalid
+	}
+	uploads := &repos.uploads
+	uploads.Lock()
+	defer uploads.Unlock()
+	if uploads.dn == "" {
+		return nil, &Error{"upload", "no repos"}
+	}
+	ownerstr, authorstr := owner.FullString(), author.FullString()
+	u := uploads.usage(authorstr)
+	u.Bytes += size
+	u.Blobs += 1
+	repos.usage.Lock()
+	err := repos.checkQuota(author, u)
+	repos.usage.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var b [UploadIdSz]byte
+	rand.Reader.Read(b[:])
+	up := &Upload{
+		ID:     hex.EncodeToString(b[:]),
+		Owner:  ownerstr,
+		Author: authorstr,
+		Size:   size,
+		Name:   name,
+	}
+	up.fn = filepath.Join(uploads.dn, up.ID)
+	f, err := os.OpenFile(up.fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	err = ioutil.WriteFile(up.fn+uploadMetaExt,
+		[]byte(fmt.Sprintln(up.Owner, up.Author, up.Size, up.Name)),
+		0660)
+	if err != nil {
+		os.Remove(up.fn)
+		return nil, err
+	}
+	return up, nil
+}
+
+// OpenUpload returns the unfinished upload of the given author and ID.
+func (repos *Repos) OpenUpload(author *User, id string) (*Upload, error) {
+	if !IsUploadId(id) {
+		return nil, os.ErrInvalid
+	}
+	repos.uploads.Lock()
+	defer repos.uploads.Unlock()
+	up, err := repos.uploads.readUpload(id)
+	if os.IsNotExist(err) {
+		return nil, ErrNOENT
+	} else if err != nil {
+		return nil, err
+	}
+	if up.Author != author.FullString() {
+		return nil, os.ErrPermission
+	}
+	return up, nil
+}
+
+// WriteUpload receives the chunk at the given offset, which may repeat one
+// that wasn't acknowledged, and returns the offset of the next.
+func (repos *Repos) WriteUpload(up *Upload, off int64,
+	r io.Reader) (int64, error) {
+	repos.uploads.Lock()
+	defer repos.uploads.Unlock()
+	f, err := os.OpenFile(up.fn, os.O_WRONLY, 0660)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if off < 0 || off > fi.Size() {
+		return fi.Size(), &Error{up.ID, fmt.Sprint("expected offset ",
+			fi.Size())}
+	}
+	if err = f.Truncate(off); err != nil {
+		return off, err
+	}
+	if _, err = f.Seek(off, os.SEEK_SET); err != nil {
+		return off, err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, up.Size-off+1))
+	if err == nil && off+n > up.Size {
+		err = &Error{up.ID, fmt.Sprint("exceeds size ", up.Size)}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(off)
+		return off, err
+	}
+	return off + n, nil
+}
+
+// CommitUpload stores the completed upload if its content has the given sum
+// and the author still has permission then removes it.
+func (repos *Repos) CommitUpload(x Sender, up *Upload, s string,
+	t time.Time) (sum *Sum, err error) {
+	repos.uploads.Lock()
+	defer repos.uploads.Unlock()
+	f, err := file.Open(up.fn)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size() != up.Size {
+		err = &Error{up.ID, fmt.Sprint("incomplete, ", fi.Size(), " of ",
+			up.Size, " bytes")}
+		return
+	}
+	if NewSumOf(f).FullString() != strings.ToLower(s) {
+		err = &Error{up.ID, "sum mismatch"}
+		return
+	}
+	owner := repos.users.UserString(up.Owner)
+	author := repos.users.UserString(up.Author)
+	if owner == nil || author == nil {
+		err = ErrNOENT
+		return
+	}
+	if err = repos.Permission(owner, author, up.Name); err != nil {
+		return
+	}
+	if _, err = f.Seek(0, os.SEEK_SET); err != nil {
+		return
+	}
+	blob := NewBlobWith(&owner.key, &author.key, up.Name, t)
+	defer blob.Free()
+	if sum, err = repos.Store(x, Latest, blob, f); err != nil {
+		return
+	}
+	repos.uploads.remove(up.ID)
+	return
+}
+
+// LoadUploads sets the directory of unfinished uploads within the given, that
+// of the repos or, with MemStorage, its tmp files.
+func (repos *Repos) LoadUploads(dn string) error {
+	uploads := &repos.uploads
+	uploads.Lock()
+	defer uploads.Unlock()
+	uploads.Mutex.Set(dn + "{uploads}")
+	uploads.dn = filepath.Join(dn, ReposUploadsDN)
+	return MkdirAll(uploads.dn)
+}
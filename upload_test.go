@@ -0,0 +1,119 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpload(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	user := newTestUser(t, repos)
+	other := newTestUser(t, repos)
+	content := "hello world"
+	size := int64(len(content))
+	up, err := repos.NewUpload(user, user, "a", size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// concurrent uploads of the same blob are distinct
+	dup, err := repos.NewUpload(user, user, "a", size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dup.ID == up.ID {
+		t.Fatal("merged uploads", up.ID)
+	}
+	if _, err = repos.WriteUpload(dup, 0,
+		strings.NewReader("xxxxxxxxxxx")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repos.OpenUpload(other, up.ID); err != os.ErrPermission {
+		t.Error("opened upload of other", err)
+	}
+	if _, err = repos.OpenUpload(user, "0123456789abcdef"); err != ErrNOENT {
+		t.Error("opened nosuch", err)
+	}
+	off, err := repos.WriteUpload(up, 0, strings.NewReader(content[:5]))
+	if err != nil || off != 5 {
+		t.Fatal(off, err)
+	}
+	// resume with the ID
+	ses := newTestSes(repos, user)
+	if v := ses.ExecUpload(nil, up.ID); v != fmt.Sprintln(up.ID, 5) {
+		t.Error("resume", v)
+	}
+	if _, err = repos.WriteUpload(up, 6, strings.NewReader("x")); err == nil {
+		t.Error("wrote beyond the end")
+	}
+	if _, err = repos.WriteUpload(up, 5,
+		strings.NewReader(content[5:]+"x")); err == nil {
+		t.Error("wrote beyond the size")
+	}
+	if _, err = repos.CommitUpload(x, up, strings.Repeat("0", 2*SumSz),
+		time.Now()); err == nil {
+		t.Error("committed incomplete upload")
+	}
+	if off, err = repos.WriteUpload(up, 5,
+		strings.NewReader(content[5:])); err != nil || off != size {
+		t.Fatal(off, err)
+	}
+	sum := NewSumOf(strings.NewReader(content)).FullString()
+	if _, err = repos.CommitUpload(x, up, strings.Repeat("0", 2*SumSz),
+		time.Now()); err == nil {
+		t.Error("committed with mismatched sum")
+	}
+	if _, err = repos.CommitUpload(x, up, sum, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := testContent(repos, repos.Join(user.Join("a"))); err != nil ||
+		s != content {
+		t.Error("uploaded", s, err)
+	}
+	if _, err = repos.OpenUpload(user, up.ID); err != ErrNOENT {
+		t.Error("committed upload remains", err)
+	}
+	if _, err = repos.OpenUpload(user, dup.ID); err != nil {
+		t.Error("lost concurrent upload", err)
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	repos.Set(Quotas{QuotaDefault: &Quota{Bytes: 1 << 10, Blobs: 2}})
+	user := newTestUser(t, repos)
+	if _, err := repos.NewUpload(user, user, "a", 1<<10+1); err != ErrQuota {
+		t.Error("upload beyond quota", err)
+	}
+	// unfinished uploads count against the quota
+	if _, err := repos.NewUpload(user, user, "a", 1<<9); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.NewUpload(user, user, "b", 1<<9+1); err != ErrQuota {
+		t.Error("uploads beyond quota bytes", err)
+	}
+	if _, err := repos.NewUpload(user, user, "b", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.NewUpload(user, user, "c", 1); err != ErrQuota {
+		t.Error("uploads beyond quota blobs", err)
+	}
+	if _, err := repos.NewUpload(user, user, "c", -1); err != os.ErrInvalid {
+		t.Error("negative size", err)
+	}
+	ses := newTestSes(repos, user)
+	if _, ok := ses.ExecUpload(bytes.NewReader(nil), "a",
+		"x").(*Usage); !ok {
+		t.Error("invalid size")
+	}
+}
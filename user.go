@@ -6,6 +6,7 @@ package main
 
 import (
 	"bytes"
+	"container/list"
 	"os"
 	"path/filepath"
 )
@@ -20,26 +21,37 @@ type User struct {
 	key    PubEncr
 	keystr string
 	logins int
+	holds  int           // while changing the cache
+	loaded bool          // cache
+	ready  chan struct{} // closed once the cache is loaded
+	pinned bool          // cache is never dropped
+	lru    *list.Element
+}
+
+func newCache(key *PubEncr) Cache {
+	c := Cache{
+		AsnAuth:        &CacheEntry{Time0, &PubAuth{}},
+		AsnAuthor:      &CacheEntry{Time0, &PubEncr{}},
+		AsnEditors:     &CacheEntry{Time0, &PubEncrList{}},
+		AsnID:          &CacheEntry{Time0, NewCacheBuffer()},
+		AsnInvites:     &CacheEntry{Time0, &PubEncrList{}},
+		AsnMark:        &CacheEntry{Time0, &Mark{}},
+		AsnModerators:  &CacheEntry{Time0, &PubEncrList{}},
+		AsnSubscribers: &CacheEntry{Time0, &PubEncrList{}},
+		AsnUser:        &CacheEntry{Time0, NewCacheBuffer()},
+		AsnVisibility:  &CacheEntry{Time0, NewCacheBuffer()},
+	}
+	c.Mark().Key.Set(key)
+	return c
 }
 
 func newUser(key *PubEncr, keystr string) (u *User) {
-	u = &User{
-		cache: Cache{
-			AsnAuth:        &CacheEntry{Time0, &PubAuth{}},
-			AsnAuthor:      &CacheEntry{Time0, &PubEncr{}},
-			AsnEditors:     &CacheEntry{Time0, &PubEncrList{}},
-			AsnID:          &CacheEntry{Time0, &CacheBuffer{}},
-			AsnInvites:     &CacheEntry{Time0, &PubEncrList{}},
-			AsnMark:        &CacheEntry{Time0, &Mark{}},
-			AsnModerators:  &CacheEntry{Time0, &PubEncrList{}},
-			AsnSubscribers: &CacheEntry{Time0, &PubEncrList{}},
-		},
+	return &User{
+		cache:  newCache(key),
 		dn:     userDN(keystr),
 		key:    *key,
 		keystr: keystr,
 	}
-	u.cache.Mark().Key.Set(key)
-	return
 }
 
 func NewUserKey(key *PubEncr) *User {
@@ -89,7 +101,7 @@ func (u *User) OnList(l *PubEncrList) bool {
 	if l == nil {
 		return false
 	}
-	for _, x := range *l {
+	for _, x := range l.Keys() {
 		if bytes.Equal(u.key.Bytes(), x.Bytes()) {
 			return true
 		}
@@ -115,6 +127,11 @@ func (u *User) Reset() {
 	copy(u.key.Bytes(), emptyKey.Bytes())
 	u.keystr = ""
 	u.logins = 0
+	u.holds = 0
+	u.loaded = false
+	u.ready = nil
+	u.pinned = false
+	u.lru = nil
 }
 
 func (u *User) Set(v interface{}) (err error) {
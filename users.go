@@ -5,22 +5,74 @@
 package main
 
 import (
-	"bytes"
+	"container/list"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/apptimistco/asn/debug/mutex"
 )
 
+// Users is the registry of repos users keyed by their key string. A user's
+// cache is loaded on lookup and, if limited with Set(int), the least recently
+// used beyond the limit are replaced by unloaded users to be reloaded on the
+// next lookup; those that are pinned, logged in or held are kept. An evicted
+// user is never changed so that it's safe for any that still have it. Caches
+// are loaded without the registry lock so that other lookups don't wait.
 type Users struct {
 	mutex.Mutex
-	l []*User
+	m      map[string]*User
+	prefix [256][]string // sorted key strings by first byte
+	lru    *list.List    // of resident users, most recent first
+	max    int
+	load   func(*User) error
 }
 
+// bucket returns the prefix bucket of the given key string or abbreviation;
+// the caller must hold the lock.
+func (users *Users) bucket(ks string) *[]string {
+	if len(ks) < ReposTopSz {
+		return nil
+	}
+	b, err := strconv.ParseUint(ks[:ReposTopSz], 16, 8)
+	if err != nil {
+		return nil
+	}
+	return &users.prefix[b]
+}
+
+// evict replaces the least recently used beyond the limit with unloaded
+// users; the caller must hold the lock.
+func (users *Users) evict() {
+	if users.max <= 0 {
+		return
+	}
+	front := users.lru.Front()
+	for e := users.lru.Back(); e != front && users.lru.Len() > users.max; {
+		u := e.Value.(*User)
+		prev := e.Prev()
+		if !u.pinned && u.logins == 0 && u.holds == 0 {
+			users.lru.Remove(e)
+			u.lru = nil
+			users.m[u.FullString()] = NewUserKey(&u.key)
+		}
+		e = prev
+	}
+}
+
+// ForEachUser calls f with each user in key order without holding the
+// registry lock; f must look up the user to use its cache.
 func (users *Users) ForEachUser(f func(*User) error) error {
+	var l []*User
 	users.Lock()
-	defer users.Unlock()
-	for _, u := range users.l {
+	for _, b := range users.prefix {
+		for _, ks := range b {
+			l = append(l, users.m[ks])
+		}
+	}
+	users.Unlock()
+	for _, u := range l {
 		if err := f(u); err != nil {
 			return err
 		}
@@ -28,104 +80,253 @@ func (users *Users) ForEachUser(f func(*User) error) error {
 	return nil
 }
 
+// ForEachLoggedInUser calls f with each logged in user; these are always
+// resident.
 func (users *Users) ForEachLoggedInUser(f func(*User) error) error {
-	return users.ForEachUser(func(u *User) error {
-		if u.logins > 0 {
-			return f(u)
+	var l []*User
+	users.Lock()
+	if users.lru != nil {
+		for e := users.lru.Front(); e != nil; e = e.Next() {
+			if u := e.Value.(*User); u.logins > 0 {
+				l = append(l, u)
+			}
 		}
-		return nil
-	})
+	}
+	users.Unlock()
+	for _, u := range l {
+		if err := f(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hold the registered version of the given user until its Release so that
+// it isn't evicted while its cache is changed.
+func (users *Users) Hold(user *User) *User {
+	users.Lock()
+	if u := users.m[user.FullString()]; u != nil {
+		user = u
+	}
+	user.holds += 1
+	ready := users.resident(user)
+	users.Unlock()
+	ready()
+	return user
 }
 
-func (users *Users) insert(user *User) {
+// insert a new user whose cache is loaded on lookup unless resident.
+func (users *Users) insert(user *User, resident bool) {
 	users.Lock()
 	defer users.Unlock()
-	n := len(users.l)
-	i := sort.Search(n, func(i int) bool {
-		return users.l[i].String() >= user.String()
-	})
-	if i == n {
-		users.l = append(users.l, user)
-	} else {
-		users.l = append(users.l[:i], append([]*User{user},
-			(users.l[i:])...)...)
+	if users.m == nil {
+		users.m = make(map[string]*User)
+		users.lru = list.New()
+	}
+	ks := user.FullString()
+	_, dup := users.m[ks]
+	users.m[ks] = user
+	if b := users.bucket(ks); b != nil && !dup {
+		i := sort.SearchStrings(*b, ks)
+		*b = append(*b, "")
+		copy((*b)[i+1:], (*b)[i:])
+		(*b)[i] = ks
+	}
+	if resident {
+		user.loaded = true
+		users.touch(user)
+	}
+}
+
+// Login the registered version of the given user, returning it.
+func (users *Users) Login(user *User) *User {
+	users.Lock()
+	if u := users.m[user.FullString()]; u != nil {
+		user = u
+	}
+	user.logins += 1
+	ready := users.resident(user)
+	users.Unlock()
+	ready()
+	return user
+}
+
+// Logout the user of the given key, if logged in.
+func (users *Users) Logout(key *PubEncr) {
+	users.Lock()
+	defer users.Unlock()
+	if u := users.m[key.FullString()]; u != nil && u.logins > 0 {
+		u.logins -= 1
 	}
 }
 
 func (users *Users) NewUserKey(key *PubEncr) *User {
 	u := NewUserKey(key)
-	users.insert(u)
+	users.insert(u, true)
 	return u
 }
 
 func (users *Users) NewUserString(keystr string) *User {
 	u := NewUserString(keystr)
-	users.insert(u)
+	users.insert(u, true)
+	return u
+}
+
+// Register an existing user without loading its cache.
+func (users *Users) Register(keystr string) *User {
+	u := NewUserString(keystr)
+	users.insert(u, false)
 	return u
 }
 
+// Release a user returned by Hold.
+func (users *Users) Release(user *User) {
+	users.Lock()
+	defer users.Unlock()
+	if user.holds > 0 {
+		user.holds -= 1
+	}
+}
+
 func (users *Users) Reset() {
 	users.Lock()
 	defer users.Unlock()
-	for i, u := range users.l {
+	for ks, u := range users.m {
 		u.Reset()
-		users.l[i] = nil
+		delete(users.m, ks)
+	}
+	for i := range users.prefix {
+		users.prefix[i] = nil
+	}
+	users.m = nil
+	users.lru = nil
+	users.load = nil
+	users.max = 0
+}
+
+// resident marks the user as the most recently used and returns a function
+// that loads its cache, if necessary, or waits for that of another lookup;
+// the caller must hold the lock but call the function without it.
+func (users *Users) resident(u *User) func() {
+	users.touch(u)
+	if u.loaded {
+		ready := u.ready
+		return func() {
+			if ready != nil {
+				<-ready
+			}
+		}
+	}
+	u.loaded = true
+	load := users.load
+	if load == nil {
+		return func() {}
+	}
+	ready := make(chan struct{})
+	u.ready = ready
+	return func() {
+		defer close(ready)
+		if err := load(u); err != nil {
+			users.Diag(u, err)
+		}
 	}
-	users.l = nil
 }
 
 func (users *Users) RM(user *User) {
 	users.Lock()
 	defer users.Unlock()
-	for i, u := range users.l {
-		if u == user {
-			u.Reset()
-			if i+1 < len(users.l) {
-				users.l = append(users.l[:i], users.l[i+1:]...)
-			} else {
-				users.l = users.l[:i]
-			}
-			return
+	ks := user.FullString()
+	if users.m[ks] != user {
+		return
+	}
+	delete(users.m, ks)
+	if b := users.bucket(ks); b != nil {
+		i := sort.SearchStrings(*b, ks)
+		if i < len(*b) && (*b)[i] == ks {
+			*b = append((*b)[:i], (*b)[i+1:]...)
 		}
 	}
+	if user.lru != nil {
+		users.lru.Remove(user.lru)
+		user.lru = nil
+	}
+	user.Reset()
 }
 
+// Set the lock name, cache loader or resident cache limit.
 func (users *Users) Set(v interface{}) error {
 	switch t := v.(type) {
 	case string:
 		users.Mutex.Set(t + "{users}")
+	case func(*User) error:
+		users.load = t
+	case int:
+		users.max = t
 	default:
 		return os.ErrInvalid
 	}
 	return nil
 }
 
-// Binary search for longest matching key.
-func (users *Users) User(key *PubEncr) (user *User) {
+// Search returns the user with the unique key-string beginning with ks;
+// ErrAmbiguos if there is more than one.
+func (users *Users) Search(ks string) (user *User, err error) {
+	ready := func() {}
 	users.Lock()
-	defer users.Unlock()
-	n := len(users.l)
-	i := sort.Search(n, func(i int) bool {
-		return bytes.Compare(users.l[i].key.Bytes(), key.Bytes()) >= 0
-	})
-	if i < n && users.l[i].key == *key {
-		user = users.l[i]
+	if user, err = users.search(strings.ToLower(ks)); user != nil {
+		ready = users.resident(user)
 	}
+	users.Unlock()
+	ready()
 	return
 }
 
-// Binary search for longest matching key-string.
-func (users *Users) UserString(ks string) (user *User) {
+// search returns the registered user with the unique key-string beginning
+// with ks; the caller must hold the lock.
+func (users *Users) search(ks string) (user *User, err error) {
+	if user = users.m[ks]; user != nil {
+		return
+	}
+	b := users.bucket(ks)
+	if b == nil {
+		return
+	}
+	i := sort.SearchStrings(*b, ks)
+	if i == len(*b) || !strings.HasPrefix((*b)[i], ks) {
+		return
+	}
+	if i+1 < len(*b) && strings.HasPrefix((*b)[i+1], ks) {
+		err = ErrAmbiguos
+		return
+	}
+	user = users.m[(*b)[i]]
+	return
+}
+
+// touch marks the user as the most recently used; the caller must hold the
+// lock.
+func (users *Users) touch(u *User) {
+	if u.lru != nil {
+		users.lru.MoveToFront(u.lru)
+		return
+	}
+	u.lru = users.lru.PushFront(u)
+	users.evict()
+}
+
+func (users *Users) User(key *PubEncr) (user *User) {
+	ready := func() {}
 	users.Lock()
-	defer users.Unlock()
-	n := len(users.l)
-	kslen := len(ks)
-	i := sort.Search(n, func(i int) bool {
-		return users.l[i].FullString() >= ks
-	})
-	if i < n && len(users.l[i].FullString()) >= kslen &&
-		users.l[i].FullString()[:kslen] == ks {
-		user = users.l[i]
+	if user = users.m[key.FullString()]; user != nil {
+		ready = users.resident(user)
 	}
+	users.Unlock()
+	ready()
+	return
+}
+
+// UserString returns the user with the unique matching key-string.
+func (users *Users) UserString(ks string) (user *User) {
+	user, _ = users.Search(ks)
 	return
 }
@@ -0,0 +1,157 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUsersEvict(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	repos.users.Set(1)
+	x := new(testSender)
+	a := newTestUser(t, repos)
+	b := newTestUser(t, repos)
+	_, err := testStore(repos, x, a, a, AsnModerators+"/"+b.FullString(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = repos.users.User(&a.key)
+	c := newTestUser(t, repos)
+	// the evicted user is unchanged for those that still have it
+	if !a.loaded || len(*(a.cache.Moderators())) != 1 {
+		t.Error("evicted user changed")
+	}
+	reloaded := repos.users.User(&a.key)
+	if reloaded == a {
+		t.Fatal("wasn't evicted")
+	}
+	if len(*(reloaded.cache.Moderators())) != 1 {
+		t.Error("reloaded", reloaded.cache.Moderators())
+	}
+	// logged in and held users are kept
+	loggedin := repos.users.Login(reloaded)
+	held := repos.users.Hold(c)
+	for i := 0; i < 3; i++ {
+		newTestUser(t, repos)
+	}
+	if repos.users.User(&a.key) != loggedin {
+		t.Error("evicted logged in user")
+	}
+	if repos.users.User(&c.key) != held {
+		t.Error("evicted held user")
+	}
+	repos.users.Logout(&a.key)
+	repos.users.Release(held)
+	newTestUser(t, repos)
+	newTestUser(t, repos)
+	if repos.users.User(&a.key) == loggedin {
+		t.Error("kept logged out user")
+	}
+	if repos.users.User(&c.key) == held {
+		t.Error("kept released user")
+	}
+	// a login of an evicted user logs in its replacement
+	if u := repos.users.Login(a); u == a || u.logins != 1 {
+		t.Error("logged in evicted user")
+	}
+}
+
+// TestUsersEvictConcurrent is meaningful with -race.
+func TestUsersEvictConcurrent(t *testing.T) {
+	const n = 8
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	repos.users.Set(2)
+	x := new(testSender)
+	var owners []*User
+	for i := 0; i < n; i++ {
+		owners = append(owners, newTestUser(t, repos))
+	}
+	var wg sync.WaitGroup
+	evict := func() {
+		defer wg.Done()
+		for i := 0; i < 64; i++ {
+			for _, u := range owners {
+				if u = repos.users.User(&u.key); u != nil {
+					// as a session would, after some time
+					runtime.Gosched()
+					repos.moderated(u, u)
+				}
+			}
+		}
+	}
+	wg.Add(2)
+	go evict()
+	go evict()
+	for i, owner := range owners {
+		wg.Add(1)
+		go func(i int, owner *User) {
+			defer wg.Done()
+			for j := 0; j < 4; j++ {
+				_, err := testStore(repos, x, owner, owner,
+					fmt.Sprint("a", j), fmt.Sprint(i, j))
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(i, owner)
+	}
+	wg.Wait()
+	for _, owner := range owners {
+		fn := repos.Join(owner.Join("a3"))
+		if _, err := repos.storage.Stat(fn); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestUsersLoad(t *testing.T) {
+	var users Users
+	defer users.Reset()
+	loading := make(chan struct{})
+	release := make(chan struct{})
+	users.Set(func(u *User) error {
+		close(loading)
+		<-release
+		u.pinned = true
+		return nil
+	})
+	a := users.Register(fmt.Sprintf("%064x", 1))
+	b := users.NewUserString(fmt.Sprintf("%064x", 2))
+	done := make(chan *User, 2)
+	go func() { done <- users.User(&a.key) }()
+	<-loading
+	// other lookups don't wait for the load
+	other := make(chan *User, 1)
+	go func() { other <- users.User(&b.key) }()
+	select {
+	case u := <-other:
+		if u != b {
+			t.Fatal("looked up", u)
+		}
+	case <-time.After(time.Second):
+		close(release)
+		t.Fatal("lookup waited for another's load")
+	}
+	// nor are those of the loading user returned before it's loaded
+	go func() { done <- users.Hold(a) }()
+	select {
+	case u := <-done:
+		t.Fatal("returned", u, "while loading")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if u := <-done; u != a || !u.pinned {
+			t.Error("returned", u, "before loaded")
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "bytes"
+
+// These are the asn/visibility content of those whose marks are sent to all
+// signed-in users, only their subscribers, or none.
+const (
+	VisibilityPublic      = "public"
+	VisibilitySubscribers = "subscribers"
+	VisibilityNobody      = "nobody"
+)
+
+// IsVisibility returns true if the given string is an asn/visibility setting.
+func IsVisibility(s string) bool {
+	switch s {
+	case VisibilityPublic, VisibilitySubscribers, VisibilityNobody:
+		return true
+	}
+	return false
+}
+
+// MarkVisible returns true if the owner's marks may be sent to the given user
+// by its asn/visibility or, if unset, to anyone unless the owner has
+// subscribers and it isn't one. The admin and server, as the service, see
+// all marks. The owner's cache is read under the users lock.
+func (repos *Repos) MarkVisible(owner, u *User) bool {
+	if u == owner ||
+		bytes.Equal(u.key.Bytes(), repos.svc.Admin.Pub.Encr.Bytes()) ||
+		bytes.Equal(u.key.Bytes(), repos.svc.Server.Pub.Encr.Bytes()) {
+		return true
+	}
+	repos.users.Lock()
+	visibility := owner.cache.Visibility()
+	subscribers := owner.cache.Subscribers().Keys()
+	repos.users.Unlock()
+	switch visibility {
+	case VisibilityPublic:
+		return true
+	case VisibilitySubscribers:
+		return u.OnList(&subscribers)
+	case VisibilityNobody:
+		return false
+	}
+	return len(subscribers) == 0 || u.OnList(&subscribers)
+}
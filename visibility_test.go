@@ -0,0 +1,116 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestMarkVisible(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	subscriber := newTestUser(t, repos)
+	stranger := newTestUser(t, repos)
+	admin := testAdmin(repos)
+	server := repos.users.User(repos.svc.Server.Pub.Encr)
+	_, err := testStore(repos, x, owner, owner,
+		AsnSubscribers+"/"+subscriber.FullString(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		visibility string
+		visible    []*User
+		hidden     []*User
+	}{
+		{"", []*User{owner, subscriber, admin, server},
+			[]*User{stranger}},
+		{VisibilityPublic, []*User{subscriber, stranger}, nil},
+		{VisibilitySubscribers, []*User{subscriber},
+			[]*User{stranger}},
+		{VisibilityNobody, []*User{owner, admin, server},
+			[]*User{subscriber, stranger}},
+	} {
+		if c.visibility != "" {
+			_, err = testStore(repos, x, owner, owner,
+				AsnVisibility, c.visibility)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, u := range c.visible {
+			if !repos.MarkVisible(owner, u) {
+				t.Error(c.visibility, "hidden from", u)
+			}
+		}
+		for _, u := range c.hidden {
+			if repos.MarkVisible(owner, u) {
+				t.Error(c.visibility, "visible to", u)
+			}
+		}
+	}
+	_, err = testStore(repos, x, owner, owner, AsnVisibility, "bogus")
+	if err == nil {
+		t.Error("stored invalid visibility")
+	}
+	if !repos.MarkVisible(owner, admin) ||
+		repos.MarkVisible(owner, stranger) {
+		t.Error("invalid visibility changed the last")
+	}
+}
+
+func TestExecCatMark(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	owner := newTestUser(t, repos)
+	stranger := newTestUser(t, repos)
+	if _, ok := newTestSes(repos, owner).ExecMark("37.0",
+		"-122.0").(*Sum); !ok {
+		t.Fatal("no mark")
+	}
+	_, err := testStore(repos, x, owner, owner, AsnVisibility,
+		VisibilityNobody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := "~" + owner.FullString() + "/" + AsnMark
+	if _, err = testCat(t, newTestSes(repos, stranger),
+		ref); err != os.ErrPermission {
+		t.Error("cat hidden mark", err)
+	}
+	for _, u := range []*User{owner, testAdmin(repos)} {
+		s, err := testCat(t, newTestSes(repos, u), ref)
+		if err != nil || s == "" {
+			t.Error(u, "cat mark", s, err)
+		}
+	}
+}
+
+// TestMarkVisibleConcurrent is meaningful with -race.
+func TestMarkVisibleConcurrent(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	owner := newTestUser(t, repos)
+	u := newTestUser(t, repos)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 64; i++ {
+			repos.reloadCache(owner)
+		}
+	}()
+	for i := 0; i < 64; i++ {
+		if !repos.MarkVisible(owner, u) {
+			t.Error("hidden without subscribers")
+		}
+	}
+	wg.Wait()
+}
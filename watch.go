@@ -0,0 +1,177 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apptimistco/asn/debug/file"
+	"github.com/apptimistco/asn/debug/mutex"
+)
+
+// Watcher receives the stored blobs that match its watches; messages only
+// if its Login is one of their recipients.
+type Watcher interface {
+	Watched(*file.File)
+	Login() *PubEncr
+}
+
+// reposWatches are the name globs of each watcher as "OWNER/GLOB" where
+// OWNER is a full key string or "*" for any user.
+type reposWatches struct {
+	mutex.Mutex
+	m map[Watcher][]string
+}
+
+// Watch adds the owner's name glob, or that of any owner if nil, to those of
+// the given watcher.
+func (repos *Repos) Watch(w Watcher, owner *User, glob string) error {
+	if _, err := path.Match(glob, ""); err != nil {
+		return err
+	}
+	s := watchString(owner, glob)
+	repos.watches.Lock()
+	defer repos.watches.Unlock()
+	if repos.watches.m == nil {
+		repos.watches.m = make(map[Watcher][]string)
+	}
+	for _, x := range repos.watches.m[w] {
+		if x == s {
+			return nil
+		}
+	}
+	repos.watches.m[w] = append(repos.watches.m[w], s)
+	return nil
+}
+
+// Unwatch removes the owner's name glob from those of the given watcher or,
+// with a nil owner and empty glob, all of them.
+func (repos *Repos) Unwatch(w Watcher, owner *User, glob string) error {
+	repos.watches.Lock()
+	defer repos.watches.Unlock()
+	if owner == nil && glob == "" {
+		delete(repos.watches.m, w)
+		return nil
+	}
+	s := watchString(owner, glob)
+	l := repos.watches.m[w]
+	for i, x := range l {
+		if x == s {
+			if l = append(l[:i], l[i+1:]...); len(l) == 0 {
+				delete(repos.watches.m, w)
+			} else {
+				repos.watches.m[w] = l
+			}
+			return nil
+		}
+	}
+	return ErrNOENT
+}
+
+// Watches lists those of the given watcher with abbreviated owners.
+func (repos *Repos) Watches(wr io.Writer, w Watcher) {
+	repos.watches.Lock()
+	l := append([]string{}, repos.watches.m[w]...)
+	repos.watches.Unlock()
+	sort.Strings(l)
+	for _, s := range l {
+		slash := strings.Index(s, "/")
+		if slash > 16 {
+			fmt.Fprintln(wr, "~"+s[:16]+s[slash:])
+		} else {
+			fmt.Fprintln(wr, "~"+s)
+		}
+	}
+}
+
+func watchString(owner *User, glob string) string {
+	if owner == nil {
+		return "*/" + glob
+	}
+	return owner.FullString() + "/" + glob
+}
+
+// watched pushes the stored blob to those watching its name, other than
+// the storing session, if it's linked as the owner's current version. Those
+// of a transaction are held until all of its blobs are linked.
+func (repos *Repos) watched(x Sender, sum *Sum, blob *Blob, f *file.File) {
+	var l []Watcher
+	if t, ok := x.(txnSender); ok {
+		b := &Blob{Owner: blob.Owner, Author: blob.Author,
+			Time: blob.Time, Name: blob.Name}
+		t.hold(f, func(f *file.File) {
+			repos.watched(t.Sender, sum, b, f)
+		})
+		return
+	}
+	repos.watches.Lock()
+	if len(repos.watches.m) == 0 {
+		repos.watches.Unlock()
+		return
+	}
+	name := blob.Name
+	message := name == "" || name == AsnMessages ||
+		strings.HasPrefix(name, AsnMessages+"/")
+	switch {
+	case name == AsnMark:
+		// marks are only sent to those permitted to see them
+		repos.watches.Unlock()
+		return
+	case name == "", name == AsnMessages, name == AsnMessages+"/":
+		name = AsnMessages + "/" + blob.FN(sum)
+	case strings.HasSuffix(name, "/"):
+		name += blob.FN(sum)
+	}
+	owner := blob.Owner.FullString()
+	if t, ok := x.(casSender); ok {
+		x = t.Sender
+	}
+	for w, globs := range repos.watches.m {
+		if s, ok := w.(Sender); ok && s == x {
+			continue
+		}
+		for _, g := range globs {
+			slash := strings.Index(g, "/")
+			if g[:slash] != "*" && g[:slash] != owner {
+				continue
+			}
+			if ok, _ := path.Match(g[slash+1:], name); ok {
+				l = append(l, w)
+				break
+			}
+		}
+	}
+	repos.watches.Unlock()
+	if len(l) == 0 {
+		return
+	}
+	fn := repos.Join(userDN(owner), filepath.FromSlash(name))
+	if t, err := repos.LinkTime(fn); err != nil || !t.Equal(blob.Time) {
+		return
+	}
+	for _, w := range l {
+		if !message || repos.recipient(blob, w.Login()) {
+			w.Watched(f)
+		}
+	}
+}
+
+// recipient returns true if the given key is that of the message's owner,
+// author, or one of the owner's subscribers or moderators.
+func (repos *Repos) recipient(blob *Blob, k *PubEncr) bool {
+	if *k == blob.Owner || *k == blob.Author {
+		return true
+	}
+	owner := repos.users.User(&blob.Owner)
+	u := repos.users.User(k)
+	return owner != nil && u != nil &&
+		(u.OnList(owner.cache.Subscribers()) ||
+			u.OnList(owner.cache.Moderators()))
+}
@@ -0,0 +1,85 @@
+// Copyright 2014-2015 Apptimist, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/apptimistco/asn/debug/file"
+	"github.com/apptimistco/asn/debug/mutex"
+)
+
+// testWatcher counts the blobs pushed to its user.
+type testWatcher struct {
+	mutex.Mutex
+	key     PubEncr
+	watched int
+}
+
+func (w *testWatcher) Login() *PubEncr { return &w.key }
+
+func (w *testWatcher) Watched(f *file.File) {
+	w.Lock()
+	defer w.Unlock()
+	w.watched++
+}
+
+// Count returns and clears the number of pushed blobs.
+func (w *testWatcher) Count() int {
+	w.Lock()
+	defer w.Unlock()
+	n := w.watched
+	w.watched = 0
+	return n
+}
+
+func TestWatchRecipients(t *testing.T) {
+	repos := newTestRepos(t, "mem")
+	defer freeTestRepos(repos)
+	x := new(testSender)
+	forum := newTestUser(t, repos)
+	author := newTestUser(t, repos)
+	subscriber := newTestUser(t, repos)
+	moderator := newTestUser(t, repos)
+	stranger := newTestUser(t, repos)
+	for _, name := range []string{
+		AsnSubscribers + "/" + subscriber.FullString(),
+		AsnModerators + "/" + moderator.FullString(),
+		AsnModerators + "/" + author.FullString(),
+	} {
+		if _, err := testStore(repos, x, forum, forum, name, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	watchers := make(map[*User]*testWatcher)
+	for _, u := range []*User{forum, author, subscriber, moderator,
+		stranger} {
+		w := &testWatcher{key: u.key}
+		if err := repos.Watch(w, nil, "*"); err != nil {
+			t.Fatal(err)
+		}
+		if err := repos.Watch(w, nil, AsnMessages+"/*"); err != nil {
+			t.Fatal(err)
+		}
+		watchers[u] = w
+	}
+	if _, err := testStore(repos, x, forum, author, "", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	for u, w := range watchers {
+		if n := w.Count(); u == stranger && n != 0 {
+			t.Error("message pushed to stranger")
+		} else if u != stranger && n != 1 {
+			t.Error("recipient watched", n, "messages")
+		}
+	}
+	// other blobs are pushed to any watcher
+	if _, err := testStore(repos, x, forum, author, "news", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if n := watchers[stranger].Count(); n != 1 {
+		t.Error("stranger watched", n, "named blobs")
+	}
+}